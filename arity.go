@@ -0,0 +1,85 @@
+package nginxconf
+
+import (
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+)
+
+// arity is the number of arguments a directive takes, max being -1 when unbounded.
+type arity struct {
+	min, max int
+}
+
+// directiveArities lists the number of arguments taken by the directives the adapter converts,
+// as documented by nginx. nginx refuses to start with any other number of arguments, while the
+// processors of the directives rely on their arguments being there.
+var directiveArities = map[string]arity{
+	"access_log":                 {1, -1},
+	"add_header":                 {2, 3},
+	"allow":                      {1, 1},
+	"break":                      {0, 0},
+	"client_max_body_size":       {1, 1},
+	"default_type":               {1, 1},
+	"deny":                       {1, 1},
+	"error_page":                 {2, -1},
+	"expires":                    {1, 2},
+	"fastcgi_index":              {1, 1},
+	"fastcgi_pass":               {1, 1},
+	"fastcgi_split_path_info":    {1, 1},
+	"gzip":                       {1, 1},
+	"hash":                       {1, 2},
+	"if":                         {1, -1},
+	"index":                      {1, -1},
+	"keepalive":                  {1, 1},
+	"keepalive_requests":         {1, 1},
+	"keepalive_timeout":          {1, 2},
+	"listen":                     {1, -1},
+	"location":                   {1, 2},
+	"map":                        {2, 2},
+	"post_action":                {1, 1},
+	"proxy_ignore_headers":       {1, -1},
+	"proxy_pass":                 {1, 1},
+	"proxy_pass_request_headers": {1, 1},
+	"proxy_set_header":           {2, 2},
+	"resolver":                   {1, -1},
+	"resolver_timeout":           {1, 1},
+	"return":                     {1, 2},
+	"rewrite":                    {2, 3},
+	"root":                       {1, 1},
+	"server_name":                {1, -1},
+	"set":                        {2, 2},
+	"slice":                      {1, 1},
+	"try_files":                  {2, -1},
+	"upstream":                   {1, 1},
+	"worker_shutdown_timeout":    {1, 1},
+}
+
+// checkArity drops the directives among dirs, and in their blocks, taking a number of arguments
+// nginx doesn't accept, with a warning each, so malformed configs are reported rather than
+// crashing the conversion. The entries of `map` blocks aren't directives and are left as is.
+func checkArity(dirs []Directive) ([]Directive, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	valid := make([]Directive, 0, len(dirs))
+	for _, dir := range dirs {
+		if a, ok := directiveArities[dir.Name()]; ok {
+			n := len(dir.Params) - 1
+			if n < a.min || (a.max >= 0 && n > a.max) {
+				warns = append(warns, caddyconfig.Warning{
+					File:      dir.File,
+					Line:      dir.Line,
+					Directive: dir.Name(),
+					Message:   fmt.Sprintf("invalid number of arguments in %s directive; the directive is ignored", dir.Name()),
+				})
+				continue
+			}
+		}
+		if len(dir.Block) > 0 && dir.Name() != "map" {
+			var w []caddyconfig.Warning
+			dir.Block, w = checkArity(dir.Block)
+			warns = append(warns, w...)
+		}
+		valid = append(valid, dir)
+	}
+	return valid, warns
+}
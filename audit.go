@@ -0,0 +1,300 @@
+package nginxconf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// AuditReport describes what an nginx config needs from Caddy, for teams assessing a migration
+// before adapting the config.
+type AuditReport struct {
+	// File is the config file audited.
+	File string `json:"file"`
+	// Directives lists the directives of the config by name, with how well they're supported.
+	Directives []DirectiveSupport `json:"directives"`
+	// Includes is the tree of the files making up the config.
+	Includes *IncludeGraph `json:"includes"`
+	// Modules lists the third-party nginx modules the config uses.
+	Modules []string `json:"modules,omitempty"`
+	// Converted is the number of directives, out of Total, the adapter converts.
+	Converted int `json:"converted"`
+	Total     int `json:"total"`
+	// Servers rates the conversion of each server block, telling which to test first.
+	Servers []ServerConfidence `json:"servers,omitempty"`
+}
+
+// The confidence ratings of the conversion of a server block.
+const (
+	// ConfidenceFull is for the server blocks converted without any warning.
+	ConfidenceFull = "full"
+	// ConfidencePartial is for the server blocks whose directives were mostly converted, some
+	// of them with caveats.
+	ConfidencePartial = "partial"
+	// ConfidenceManualReview is for the server blocks with more than a tenth of their
+	// directives not converted, which need a close look.
+	ConfidenceManualReview = "manual-review-needed"
+)
+
+// ServerConfidence rates the conversion of a server block.
+type ServerConfidence struct {
+	// Name is the first name of the server block, or its position if it has none.
+	Name       string `json:"name"`
+	File       string `json:"file"`
+	Line       int    `json:"line"`
+	Confidence string `json:"confidence"`
+	// Converted is the number of directives of the block, out of Total, the adapter converts,
+	// Caveats the number of them converted with caveats.
+	Converted int `json:"converted"`
+	Caveats   int `json:"caveats,omitempty"`
+	Total     int `json:"total"`
+}
+
+// serverConfidences rates the conversion of each server block among dirs given the warnings
+// of the adaptation.
+func serverConfidences(dirs []Directive, warnings []caddyconfig.Warning) []ServerConfidence {
+	unsupported := make(map[caddyconfig.Warning]bool)
+	caveats := make(map[caddyconfig.Warning]bool)
+	for _, w := range warnings {
+		pos := caddyconfig.Warning{File: w.File, Line: w.Line, Directive: w.Directive}
+		if strings.HasPrefix(w.Message, ErrUnrecognized) {
+			unsupported[pos] = true
+		} else {
+			caveats[pos] = true
+		}
+	}
+
+	var servers []ServerConfidence
+	var rate func(dirs []Directive, sc *ServerConfidence)
+	rate = func(dirs []Directive, sc *ServerConfidence) {
+		for _, dir := range dirs {
+			pos := caddyconfig.Warning{File: dir.File, Line: dir.Line, Directive: dir.Name()}
+			sc.Total++
+			switch {
+			case unsupported[pos]:
+			case caveats[pos]:
+				sc.Converted++
+				sc.Caveats++
+			default:
+				sc.Converted++
+			}
+			rate(dir.Block, sc)
+		}
+	}
+	for _, httpDir := range getAllDirectives(dirs, "http") {
+		for _, dir := range getAllDirectives(httpDir.Block, "server") {
+			sc := ServerConfidence{
+				Name: fmt.Sprintf("server at %s:%d", dir.File, dir.Line),
+				File: dir.File,
+				Line: dir.Line,
+			}
+			if hosts := serverNames(getAllDirectives(dir.Block, "server_name")); len(hosts) > 0 {
+				sc.Name = hosts[0]
+			}
+			rate(dir.Block, &sc)
+			switch {
+			case sc.Converted == sc.Total && sc.Caveats == 0:
+				sc.Confidence = ConfidenceFull
+			case (sc.Total-sc.Converted)*10 <= sc.Total:
+				sc.Confidence = ConfidencePartial
+			default:
+				sc.Confidence = ConfidenceManualReview
+			}
+			servers = append(servers, sc)
+		}
+	}
+	return servers
+}
+
+// DirectiveSupport counts the uses of a directive and how many of them the adapter can't convert,
+// or only converts with caveats.
+type DirectiveSupport struct {
+	Name        string `json:"name"`
+	Uses        int    `json:"uses"`
+	Unsupported int    `json:"unsupported,omitempty"`
+	Caveats     int    `json:"caveats,omitempty"`
+}
+
+// thirdPartyModules maps the prefixes of directive names to the third-party nginx modules
+// providing them.
+var thirdPartyModules = map[string]string{
+	"more_":                "headers-more",
+	"lua_":                 "lua (OpenResty)",
+	"content_by_lua":       "lua (OpenResty)",
+	"access_by_lua":        "lua (OpenResty)",
+	"rewrite_by_lua":       "lua (OpenResty)",
+	"js_":                  "njs",
+	"brotli":               "brotli",
+	"geoip2":               "geoip2",
+	"modsecurity":          "ModSecurity",
+	"pagespeed":            "PageSpeed",
+	"vhost_traffic_status": "traffic status",
+	"auth_jwt":             "JWT authentication (NGINX Plus)",
+	"passenger_":           "Phusion Passenger",
+	"echo":                 "echo",
+}
+
+// Audit parses the nginx config in body and reports what it needs from Caddy: the support of
+// each directive, the include tree, the third-party modules used and the share of directives
+// converted. It takes the same options as Adapt, and no config is produced.
+func Audit(body []byte, options map[string]interface{}) (AuditReport, error) {
+	filename, layout := inputOptions(options)
+	dirs, graph, err := parseWithGraph(body, filename, layout)
+	if err != nil {
+		return AuditReport{}, err
+	}
+	report := AuditReport{
+		File:     filename,
+		Includes: graph,
+		Total:    countDirectives(dirs),
+	}
+
+	uses := make(map[string]*DirectiveSupport)
+	modules := make(map[string]bool)
+	byPosition := make(map[caddyconfig.Warning]string)
+	var walk func(dirs []Directive)
+	walk = func(dirs []Directive) {
+		for _, dir := range dirs {
+			support, ok := uses[dir.Name()]
+			if !ok {
+				support = &DirectiveSupport{Name: dir.Name()}
+				uses[dir.Name()] = support
+			}
+			support.Uses++
+			byPosition[caddyconfig.Warning{File: dir.File, Line: dir.Line, Directive: dir.Name()}] = dir.Name()
+			for prefix, module := range thirdPartyModules {
+				if strings.HasPrefix(dir.Name(), prefix) {
+					modules[module] = true
+				}
+			}
+			if dir.Name() != "map" {
+				walk(dir.Block)
+			}
+		}
+	}
+	walk(dirs)
+
+	// the conversion, whose output is discarded, tells which directives are supported
+	ss := setupState{
+		servers: make(map[string]*caddyhttp.Server),
+	}
+	warnings, err := ss.mainContext(dirs)
+	if err != nil {
+		return AuditReport{}, err
+	}
+	unsupported := make(map[caddyconfig.Warning]bool)
+	caveats := make(map[caddyconfig.Warning]bool)
+	for _, w := range warnings {
+		pos := caddyconfig.Warning{File: w.File, Line: w.Line, Directive: w.Directive}
+		if _, ok := byPosition[pos]; !ok {
+			continue
+		}
+		if strings.HasPrefix(w.Message, ErrUnrecognized) {
+			unsupported[pos] = true
+		} else {
+			caveats[pos] = true
+		}
+	}
+	for pos := range unsupported {
+		uses[byPosition[pos]].Unsupported++
+		delete(caveats, pos)
+	}
+	for pos := range caveats {
+		uses[byPosition[pos]].Caveats++
+	}
+	report.Converted = report.Total - len(unsupported)
+	report.Servers = serverConfidences(dirs, warnings)
+
+	for _, support := range uses {
+		report.Directives = append(report.Directives, *support)
+	}
+	sort.Slice(report.Directives, func(i, j int) bool {
+		return report.Directives[i].Name < report.Directives[j].Name
+	})
+	for module := range modules {
+		report.Modules = append(report.Modules, module)
+	}
+	sort.Strings(report.Modules)
+	return report, nil
+}
+
+// IncludeGraphOf parses the nginx config in body and returns the tree of the files it includes,
+// along with the includes matching no file. It takes the same options as Adapt.
+func IncludeGraphOf(body []byte, options map[string]interface{}) (*IncludeGraph, error) {
+	filename, layout := inputOptions(options)
+	_, graph, err := parseWithGraph(body, filename, layout)
+	return graph, err
+}
+
+// parseWithGraph parses the nginx config in body, recording the included files rather than
+// failing on includes matching no file.
+func parseWithGraph(body []byte, filename string, layout confLayout) ([]Directive, *IncludeGraph, error) {
+	parser := nginxParser{
+		tokens: tokenize(body, filename),
+		layout: layout,
+		graph:  newIncludeGraph(filename, body),
+	}
+	dirs, err := parser.nextBlock()
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing: %v", err)
+	}
+	return dirs, parser.graph, nil
+}
+
+// Coverage returns the percentage of directives the adapter converts.
+func (r AuditReport) Coverage() float64 {
+	if r.Total == 0 {
+		return 100
+	}
+	return float64(r.Converted) * 100 / float64(r.Total)
+}
+
+// String formats the report for reading in a terminal.
+func (r AuditReport) String() string {
+	var sb strings.Builder
+
+	sb.WriteString("Directives:\n")
+	tw := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  NAME\tUSES\tSTATUS")
+	for _, d := range r.Directives {
+		status := "supported"
+		switch {
+		case d.Unsupported == d.Uses:
+			status = "unsupported"
+		case d.Unsupported > 0:
+			status = fmt.Sprintf("%d unsupported", d.Unsupported)
+		}
+		if d.Caveats > 0 {
+			status += fmt.Sprintf(", %d with caveats", d.Caveats)
+		}
+		fmt.Fprintf(tw, "  %s\t%d\t%s\n", d.Name, d.Uses, status)
+	}
+	tw.Flush()
+
+	sb.WriteString("\nInclude tree:\n")
+	sb.WriteString(r.Includes.String())
+
+	if len(r.Modules) > 0 {
+		sb.WriteString("\nThird-party modules:\n")
+		for _, m := range r.Modules {
+			fmt.Fprintf(&sb, "  %s\n", m)
+		}
+	}
+
+	if len(r.Servers) > 0 {
+		sb.WriteString("\nServers:\n")
+		tw := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "  NAME\tCONFIDENCE\tCONVERTED")
+		for _, s := range r.Servers {
+			fmt.Fprintf(tw, "  %s\t%s\t%d of %d\n", s.Name, s.Confidence, s.Converted, s.Total)
+		}
+		tw.Flush()
+	}
+
+	fmt.Fprintf(&sb, "\nCoverage: %d of %d directives converted (%.1f%%)\n", r.Converted, r.Total, r.Coverage())
+	return sb.String()
+}
@@ -0,0 +1,158 @@
+package nginxconf
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "nginx-audit",
+		Func:  cmdNginxAudit,
+		Usage: "--config <path> [--prefix <dir>] [--includes] [--json]",
+		Short: "Reports what an nginx config needs before adapting it",
+		Long: `
+Parses the nginx config at --config without producing a Caddy config, and
+prints how well each directive is supported, the tree of included files,
+the third-party nginx modules used and the share of directives the nginx
+adapter converts.
+
+--prefix overrides the nginx installation directory that included files
+are looked up in. With --includes, only the tree of included files is
+printed, with their line counts and the include patterns matching no
+file. With --json, the report is printed as JSON.`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("nginx-audit", flag.ExitOnError)
+			fs.String("config", "", "The nginx config file to audit")
+			fs.String("prefix", "", "The nginx installation directory")
+			fs.Bool("includes", false, "Print only the tree of included files")
+			fs.Bool("json", false, "Print the report as JSON")
+			return fs
+		}(),
+	})
+
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "nginx-split",
+		Func:  cmdNginxSplit,
+		Usage: "--config <path> --output <dir> [--prefix <dir>] [--only-hosts <names>] [--normalize [--minify]] [--stamp]",
+		Short: "Adapts an nginx config to a Caddy config per server",
+		Long: `
+Adapts the nginx config at --config to Caddy JSON, writing a separate
+config for each Caddy server into the --output directory, named after
+the first server_name of the server. This way the virtual hosts can be
+migrated and reviewed one at a time. The server blocks sharing a listener
+address make up a single Caddy server, thus a single file.
+
+--prefix overrides the nginx installation directory that included files
+are looked up in. --only-hosts limits the adaptation to the server blocks
+with a name matching one of the given comma-separated patterns, such as
+example.com,*.api.example.com. With --normalize, the null and empty
+fields are left out of the configs and their keys are sorted, so the
+configs produced by different adapter versions make small diffs when
+stored in Git. The configs are indented unless --minify is given as well.
+With --stamp, each config records the adapter version and the checksum of
+the nginx config files in its top-level @id, which Caddy ignores.
+The warnings of the adaptation are printed to stderr.`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("nginx-split", flag.ExitOnError)
+			fs.String("config", "", "The nginx config file to adapt")
+			fs.String("output", "", "The directory to write the Caddy configs to")
+			fs.String("prefix", "", "The nginx installation directory")
+			fs.String("only-hosts", "", "The comma-separated patterns of the server names to adapt")
+			fs.Bool("normalize", false, "Leave out the empty fields and sort the keys of the configs")
+			fs.Bool("minify", false, "Write the normalized configs without indentation")
+			fs.Bool("stamp", false, "Record the adapter version and the checksum of the nginx config in the configs")
+			return fs
+		}(),
+	})
+}
+
+func cmdNginxSplit(fl caddycmd.Flags) (int, error) {
+	configFile, outputDir := fl.String("config"), fl.String("output")
+	if configFile == "" || outputDir == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--config and --output are required")
+	}
+	body, err := os.ReadFile(configFile)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("reading config file: %v", err)
+	}
+	configs, warnings, err := AdaptPerServer(body, map[string]interface{}{
+		"filename":   configFile,
+		"prefix":     fl.String("prefix"),
+		"only_hosts": fl.String("only-hosts"),
+		"normalize":  fl.Bool("normalize"),
+		"minify":     fl.Bool("minify"),
+		"stamp":      fl.Bool("stamp"),
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "[WARNING][%s] %s\n", configFile, w.String())
+	}
+
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	written := make(map[string]bool)
+	for _, name := range names {
+		filename := serverFilename(name)
+		for i := 2; written[filename]; i++ {
+			filename = serverFilename(fmt.Sprintf("%s_%d", name, i))
+		}
+		written[filename] = true
+		path := filepath.Join(outputDir, filename)
+		if err := os.WriteFile(path, configs[name], 0o644); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		fmt.Println(path)
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdNginxAudit(fl caddycmd.Flags) (int, error) {
+	configFile := fl.String("config")
+	if configFile == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--config is required")
+	}
+	body, err := os.ReadFile(configFile)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("reading config file: %v", err)
+	}
+	options := map[string]interface{}{
+		"filename": configFile,
+		"prefix":   fl.String("prefix"),
+	}
+	var report fmt.Stringer
+	if fl.Bool("includes") {
+		report, err = IncludeGraphOf(body, options)
+	} else {
+		report, err = Audit(body, options)
+	}
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if fl.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(report); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		return caddy.ExitCodeSuccess, nil
+	}
+	fmt.Print(report)
+	return caddy.ExitCodeSuccess, nil
+}
@@ -16,22 +16,29 @@ import (
 func (ss *setupState) ifContext(dirs []Directive) ([]json.RawMessage, []caddyconfig.Warning) {
 	var warnings []caddyconfig.Warning
 	var handlers []json.RawMessage
+	var accessRulesSeen bool
 	for _, dir := range dirs {
 		var warns []caddyconfig.Warning
 		switch dir.Name() {
-		case "break":
-			h := caddyhttp.StaticResponse{
-				Close: true,
+		case "allow", "deny":
+			if accessRulesSeen {
+				continue // all of the block's rules are converted together
 			}
-			encodedHandler := caddyconfig.JSONModuleObject(h, "handler", "static_response", &warns)
-			handlers = append(handlers, encodedHandler)
+			accessRulesSeen = true
+			h, w := processAccessRules(dirs, ss.deniedHandlers(&warns))
+			warns = append(warns, w...)
+			if h != nil {
+				handlers = append(handlers, caddyconfig.JSONModuleObject(h, "handler", "subroute", &warns))
+			}
+		case "break":
+			handlers = append(handlers, breakHandler(serverBreakVar, &warns))
 		case "return":
-			h, w := processReturn(dir)
+			h, w := processReturn(dir, ss.defaultType)
 			warns = append(warns, w...)
 			encodedHandler := caddyconfig.JSONModuleObject(h, "handler", "static_response", &warns)
 			handlers = append(handlers, encodedHandler)
 		case "rewrite":
-			h, w := processRewrite(dir)
+			h, w := processRewrite(dir, serverBreakVar, nil)
 			warns = append(warns, w...)
 			encodedHandler := caddyconfig.JSONModuleObject(h, "handler", "subroute", &warns)
 			handlers = append(handlers, encodedHandler)
@@ -53,12 +60,27 @@ func (ss *setupState) ifContext(dirs []Directive) ([]json.RawMessage, []caddycon
 	return handlers, warnings
 }
 
-func (ss *setupState) ifInLocationContext(dirs []Directive) ([]json.RawMessage, []caddyconfig.Warning) {
+// ifInLocationContext converts the block dirs of an `if` directive in a location whose `break` is
+// tracked by breakVar.
+func (ss *setupState) ifInLocationContext(dirs []Directive, breakVar string) ([]json.RawMessage, []caddyconfig.Warning) {
 	var warnings []caddyconfig.Warning
 	var handlers []json.RawMessage
+	var accessRulesSeen bool
 	for _, dir := range dirs {
 		var warns []caddyconfig.Warning
 		switch dir.Name() {
+		case "allow", "deny":
+			if accessRulesSeen {
+				continue // all of the block's rules are converted together
+			}
+			accessRulesSeen = true
+			h, w := processAccessRules(dirs, ss.deniedHandlers(&warns))
+			warns = append(warns, w...)
+			if h != nil {
+				handlers = append(handlers, caddyconfig.JSONModuleObject(h, "handler", "subroute", &warns))
+			}
+		case "break":
+			handlers = append(handlers, breakHandler(breakVar, &warns))
 		case "root":
 			fileServer := fileserver.FileServer{
 				Root: dir.Param(1),
@@ -66,7 +88,7 @@ func (ss *setupState) ifInLocationContext(dirs []Directive) ([]json.RawMessage,
 			}
 			handlers = append(handlers, caddyconfig.JSONModuleObject(fileServer, "handler", "file_server", &warns))
 		case "fastcgi_pass":
-			h, w := processFastCGIPass([]Directive{dir})
+			h, w := processFastCGIPass([]Directive{dir}, ss.upstreams)
 			warns = append(warns, w...)
 			handlers = append(handlers, caddyconfig.JSONModuleObject(h, "handler", "subroute", &warns))
 		case "gzip":
@@ -77,7 +99,7 @@ func (ss *setupState) ifInLocationContext(dirs []Directive) ([]json.RawMessage,
 			}
 			handlers = append(handlers, caddyconfig.JSONModuleObject(h, "handler", "encode", &warns))
 		case "add_header":
-			hdr, w := processAddHeader(dir)
+			hdr, w := processAddHeader(dir, dirs)
 			warns = append(warns, w...)
 			handlers = append(handlers, caddyconfig.JSONModuleObject(hdr, "handler", "headers", &warns))
 		case "expires":
@@ -85,7 +107,8 @@ func (ss *setupState) ifInLocationContext(dirs []Directive) ([]json.RawMessage,
 			warns = append(warns, w...)
 			handlers = append(handlers, caddyconfig.JSONModuleObject(hdr, "handler", "headers", &warns))
 		case "proxy_pass":
-			h, w := processProxyPass(dir, ss.upstreams)
+			// the proxy directives can't be set in `if`, those of the location apply
+			h, w := processProxyPass(append([]Directive{dir}, ss.proxySettings...), ss.upstreams)
 			warns = append(warns, w...)
 			handlers = append(handlers, caddyconfig.JSONModuleObject(h, "handler", "reverse_proxy", &warns))
 		default:
@@ -101,38 +124,55 @@ func (ss *setupState) ifInLocationContext(dirs []Directive) ([]json.RawMessage,
 	return handlers, warnings
 }
 
+// ifBreaks reports whether the block of an `if` directive may stop processing the rewrite-phase
+// directives of the enclosing scope.
+func ifBreaks(dirs []Directive) bool {
+	for _, dir := range dirs {
+		if dir.Name() == "break" || (dir.Name() == "rewrite" && rewriteBreaks(dir)) {
+			return true
+		}
+	}
+	return false
+}
+
 func calculateIfMatcher(dir Directive) (caddy.ModuleMap, []caddyconfig.Warning) {
 	var warns []caddyconfig.Warning
 	var routeMatcher caddy.ModuleMap
 
-	switch len(dir.Params) {
-	case 2: // something like this: if ($invalid_referer)
-		arg := strings.Trim(dir.Param(1), "()")
+	// the parentheses are tokens of their own next to quoted operands, e.g. `if ($a = "")`
+	params := dir.Params[1:]
+	if len(params) > 0 && params[0] == "(" {
+		params = params[1:]
+	}
+	if len(params) > 0 && params[len(params)-1] == ")" {
+		params = params[:len(params)-1]
+	}
+
+	switch len(params) {
+	case 1: // something like this: if ($invalid_referer)
+		// the condition holds unless the variable is empty or "0", which is also the case of
+		// the cookies and query arguments missing from the request
+		arg := strings.Trim(params[0], "()")
 		routeMatcher = caddy.ModuleMap{
-			"vars": caddyconfig.JSON(caddyhttp.VarsMatcher{getCaddyVar(arg): []string{"true"}}, &warns),
+			"not": caddyconfig.JSON(caddyhttp.MatchNot{
+				MatcherSetsRaw: []caddy.ModuleMap{
+					{
+						"vars": caddyconfig.JSON(caddyhttp.VarsMatcher{getCaddyVar(arg): []string{"", "0"}}, &warns),
+					},
+				},
+			}, &warns),
 		}
-	case 4: // something like this: if ($http_cookie ~* "id=([^;]+)(?:;|$)")
-		loperand, op, roperand := strings.TrimLeft(dir.Param(1), "("), dir.Param(2), strings.TrimRight(dir.Param(3), ")")
+	case 3: // something like this: if ($http_cookie ~* "id=([^;]+)(?:;|$)")
+		loperand, op, roperand := strings.TrimPrefix(params[0], "("), params[1], strings.TrimSuffix(params[2], ")")
 		switch op {
 		case "=":
-			// Caddy sets a collection of HTTP variables to the request context, so the VarMatcher
-			// as wildcard matcher.
-			// https://github.com/caddyserver/caddy/blob/271b5af14894a8cca5fc6aa6f1c17823a1fb5ff3/modules/caddyhttp/server.go#L139
-			routeMatcher = caddy.ModuleMap{
-				"vars": caddyconfig.JSON(caddyhttp.VarsMatcher{getCaddyVar(loperand): []string{roperand}}, &warns),
-			}
+			routeMatcher = ifEqualityMatcher(loperand, roperand, &warns)
 		case "~", "!~", "~*", "!~*": // regexps
 			pattern := roperand
-			if strings.HasSuffix(pattern, "*") {
+			if strings.HasSuffix(op, "*") {
 				pattern = "(?i)" + pattern // case-insensitive matching
 			}
-			routeMatcher = caddy.ModuleMap{
-				"vars_regexp": caddyconfig.JSON(caddyhttp.MatchVarsRE{
-					getCaddyVar(loperand): &caddyhttp.MatchRegexp{
-						Pattern: pattern,
-					},
-				}, &warns),
-			}
+			routeMatcher = ifRegexpMatcher(loperand, pattern, &warns)
 			if op == "!~" || op == "!~*" {
 				routeMatcher = caddy.ModuleMap{
 					"not": caddyconfig.JSON(caddyhttp.MatchNot{
@@ -147,7 +187,7 @@ func calculateIfMatcher(dir Directive) (caddy.ModuleMap, []caddyconfig.Warning)
 				File:      dir.File,
 				Line:      dir.Line,
 				Directive: dir.Name(),
-				Message:   fmt.Sprintf("unsupported `if` operator: %s", dir.Param(2)),
+				Message:   fmt.Sprintf("unsupported `if` operator: %s", op),
 			})
 			return nil, warns
 		}
@@ -162,3 +202,79 @@ func calculateIfMatcher(dir Directive) (caddy.ModuleMap, []caddyconfig.Warning)
 	}
 	return routeMatcher, warns
 }
+
+// requestURIPlaceholder is the URI of the request as the client sent it, with its query string,
+// which `$request_uri` conditions compare.
+const requestURIPlaceholder = "{http.request.orig_uri}"
+
+// ifEqualityMatcher returns the matcher for the `if ($operand = value)` condition. The host and
+// the query arguments get their dedicated matcher, everything else falls back to matching the
+// placeholder value, e.g. $request_uri compared as a whole with its query string.
+func ifEqualityMatcher(operand, value string, warns *[]caddyconfig.Warning) caddy.ModuleMap {
+	switch operand {
+	case "$host":
+		return caddy.ModuleMap{
+			"host": caddyconfig.JSON(caddyhttp.MatchHost{value}, warns),
+		}
+	case "$uri", "$document_uri":
+		// the path matcher is case-insensitive, unlike nginx's comparison
+		return caddy.ModuleMap{
+			"vars": caddyconfig.JSON(caddyhttp.VarsMatcher{"{http.request.uri.path}": []string{value}}, warns),
+		}
+	case "$request_uri":
+		// nginx's variable is the URI the client requested, before any rewrite
+		return caddy.ModuleMap{
+			"vars": caddyconfig.JSON(caddyhttp.VarsMatcher{requestURIPlaceholder: []string{value}}, warns),
+		}
+	}
+	if name := strings.TrimPrefix(operand, "$arg_"); name != operand && value != "" {
+		// a missing argument compares equal to the empty string, which the query matcher
+		// doesn't match, hence the placeholder below for that case
+		return caddy.ModuleMap{
+			"query": caddyconfig.JSON(caddyhttp.MatchQuery{name: []string{value}}, warns),
+		}
+	}
+	// Caddy has no cookie matcher, but the cookie placeholders are empty for the missing
+	// cookies as nginx's $cookie_* variables, e.g. for `if ($cookie_session = "")`.
+	//
+	// Caddy sets a collection of HTTP variables to the request context, so the VarMatcher
+	// as wildcard matcher.
+	// https://github.com/caddyserver/caddy/blob/271b5af14894a8cca5fc6aa6f1c17823a1fb5ff3/modules/caddyhttp/server.go#L139
+	return caddy.ModuleMap{
+		"vars": caddyconfig.JSON(caddyhttp.VarsMatcher{getCaddyVar(operand): []string{value}}, warns),
+	}
+}
+
+// ifRegexpMatcher returns the matcher for the `if ($operand ~ pattern)` condition. Negation is
+// left to the caller.
+func ifRegexpMatcher(operand, pattern string, warns *[]caddyconfig.Warning) caddy.ModuleMap {
+	// $host falls back to the placeholder, which as nginx's variable has no port unlike the
+	// Host header field
+	switch operand {
+	case "$uri", "$document_uri":
+		return caddy.ModuleMap{
+			"path_regexp": caddyconfig.JSON(caddyhttp.MatchPathRE{
+				MatchRegexp: caddyhttp.MatchRegexp{
+					Pattern: pattern,
+				},
+			}, warns),
+		}
+	case "$request_uri":
+		// the pattern is matched against the query string as well, e.g. `\.php$` doesn't match
+		// `/index.php?page=1`, and against the URI the client requested, before any rewrite
+		return caddy.ModuleMap{
+			"vars_regexp": caddyconfig.JSON(caddyhttp.MatchVarsRE{
+				requestURIPlaceholder: &caddyhttp.MatchRegexp{
+					Pattern: pattern,
+				},
+			}, warns),
+		}
+	}
+	return caddy.ModuleMap{
+		"vars_regexp": caddyconfig.JSON(caddyhttp.MatchVarsRE{
+			getCaddyVar(operand): &caddyhttp.MatchRegexp{
+				Pattern: pattern,
+			},
+		}, warns),
+	}
+}
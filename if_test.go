@@ -0,0 +1,64 @@
+package nginxconf
+
+import "testing"
+
+func TestIfConditions(t *testing.T) {
+	runAdaptTests(t, []adaptTest{
+		{
+			name: "host regexp without the port",
+			conf: `http {
+				server {
+					listen 80;
+					if ($host ~* ^www[.]) {
+						return 403;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.match": `[{"vars_regexp":{"{http.request.host}":{"pattern":"(?i)^www[.]"}}}]`,
+			},
+		},
+		{
+			name: "request URI compared as a whole",
+			conf: `http {
+				server {
+					listen 80;
+					if ($request_uri = /index.php?page=1) {
+						return 404;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.match": `[{"vars":{"{http.request.orig_uri}":["/index.php?page=1"]}}]`,
+			},
+		},
+		{
+			name: "request URI regexp anchored at the end",
+			conf: `http {
+				server {
+					listen 80;
+					if ($request_uri ~ \.php$) {
+						return 404;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.match": `[{"vars_regexp":{"{http.request.orig_uri}":{"pattern":"\\.php$"}}}]`,
+			},
+		},
+		{
+			name: "path compared with its case",
+			conf: `http {
+				server {
+					listen 80;
+					if ($uri = /Admin) {
+						return 404;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.match": `[{"vars":{"{http.request.uri.path}":["/Admin"]}}]`,
+			},
+		},
+	})
+}
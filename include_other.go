@@ -0,0 +1,29 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package nginxconf
+
+import "path/filepath"
+
+// normalizeIncludePath cleans the argument of an `include` directive found in currentFile.
+func normalizeIncludePath(arg, currentFile string) string {
+	return filepath.Clean(arg)
+}
+
+// stdConfPath returns the location of the standard snippet named name in the installation at prefix.
+func stdConfPath(prefix, name string) string {
+	return filepath.Join(prefix, name)
+}
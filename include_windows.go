@@ -0,0 +1,41 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package nginxconf
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// normalizeIncludePath cleans the argument of an `include` directive found in currentFile.
+// nginx/Windows accepts both forward slashes and backslashes, so the argument is converted
+// to the native separator. A path such as `\nginx\conf\mime.types` is rooted but carries no
+// drive letter, in which case nginx resolves it on the current drive. The closest equivalent
+// available to the adapter is the drive of the file doing the including.
+func normalizeIncludePath(arg, currentFile string) string {
+	arg = filepath.Clean(filepath.FromSlash(arg))
+	if filepath.VolumeName(arg) == "" && strings.HasPrefix(arg, `\`) {
+		arg = filepath.VolumeName(currentFile) + arg
+	}
+	return arg
+}
+
+// stdConfPath returns the location of the standard snippet named name in the installation at
+// prefix. The nginx/Windows distribution ships them in the "conf" directory next to nginx.exe.
+func stdConfPath(prefix, name string) string {
+	return filepath.Join(prefix, "conf", name)
+}
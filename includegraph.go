@@ -0,0 +1,94 @@
+package nginxconf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// IncludeGraph is the resolved tree of the files making up an nginx config, for debugging why
+// parts of a config aren't picked up.
+type IncludeGraph struct {
+	Root *IncludedFile `json:"root"`
+	// Unresolved lists the include directives matching no file.
+	Unresolved []UnresolvedInclude `json:"unresolved,omitempty"`
+
+	// the latest node of each file, which the includes found in the file are attached to
+	nodes map[string]*IncludedFile
+}
+
+// IncludedFile is a file of an nginx config along with the files it includes, in order.
+type IncludedFile struct {
+	Path  string `json:"path"`
+	Lines int    `json:"lines"`
+	// Pattern and Line are the argument and the line of the directive including the file,
+	// empty for the root of the config.
+	Pattern  string          `json:"pattern,omitempty"`
+	Line     int             `json:"line,omitempty"`
+	Includes []*IncludedFile `json:"includes,omitempty"`
+}
+
+// UnresolvedInclude is an include directive matching no file.
+type UnresolvedInclude struct {
+	Pattern string `json:"pattern"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	// Tried lists the paths looked up for the included file.
+	Tried []string `json:"tried,omitempty"`
+}
+
+func newIncludeGraph(root string, body []byte) *IncludeGraph {
+	g := &IncludeGraph{
+		Root:  &IncludedFile{Path: root, Lines: countLines(body)},
+		nodes: make(map[string]*IncludedFile),
+	}
+	g.nodes[root] = g.Root
+	return g
+}
+
+// add records that the include directive at includeToken, whose argument is pattern, includes
+// the file at path with the given number of lines.
+func (g *IncludeGraph) add(includeToken token, pattern, path string, lines int) {
+	node := &IncludedFile{Path: path, Lines: lines, Pattern: pattern, Line: includeToken.line}
+	if parent, ok := g.nodes[includeToken.file]; ok {
+		parent.Includes = append(parent.Includes, node)
+	} else {
+		g.Root.Includes = append(g.Root.Includes, node)
+	}
+	g.nodes[path] = node
+}
+
+// String prints the graph as a tree.
+func (g *IncludeGraph) String() string {
+	var sb strings.Builder
+	var printFile func(f *IncludedFile, indent string)
+	printFile = func(f *IncludedFile, indent string) {
+		fmt.Fprintf(&sb, "%s%s (%d lines", indent, f.Path, f.Lines)
+		if f.Pattern != "" {
+			fmt.Fprintf(&sb, ", from `include %s` at line %d", f.Pattern, f.Line)
+		}
+		sb.WriteString(")\n")
+		for _, inc := range f.Includes {
+			printFile(inc, indent+"  ")
+		}
+	}
+	printFile(g.Root, "  ")
+	if len(g.Unresolved) > 0 {
+		sb.WriteString("Unresolved:\n")
+		for _, u := range g.Unresolved {
+			fmt.Fprintf(&sb, "  %s:%d %s\n", u.File, u.Line, u.Pattern)
+			for _, path := range u.Tried {
+				fmt.Fprintf(&sb, "    tried %s\n", path)
+			}
+		}
+	}
+	return sb.String()
+}
+
+func countLines(b []byte) int {
+	n := bytes.Count(b, []byte("\n"))
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		n++
+	}
+	return n
+}
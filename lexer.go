@@ -94,8 +94,16 @@ func (l *nginxLexer) nextToken() bool {
 				l.line++
 			}
 			if escaped {
-				// only escape quotes
-				if ch != quoted {
+				// like nginx, only unescape quotes, backslashes and the \t, \r and \n sequences
+				switch ch {
+				case quoted, '\\':
+				case 't':
+					ch = '\t'
+				case 'r':
+					ch = '\r'
+				case 'n':
+					ch = '\n'
+				default:
 					val = append(val, '\\')
 				}
 			}
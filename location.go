@@ -2,6 +2,9 @@ package nginxconf
 
 import (
 	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/caddyserver/caddy/v2/caddyconfig"
@@ -9,16 +12,232 @@ import (
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/fileserver"
 )
 
+// The ranks of the location modifiers, in the order nginx selects the location of a request in:
+// the exact matches first, then the prefixes stopping the search for regexps, the regexps in their
+// order and finally the other prefixes.
+const (
+	rankExact = iota
+	rankPrefixNoRegexp
+	rankRegexp
+	rankPrefix
+)
+
+// locationRank returns the rank of the top-level location directive dir, and the path or the
+// prefix it matches if it isn't a regexp location.
+func locationRank(dir Directive) (int, string) {
+	if len(dir.Params) > 2 {
+		switch dir.Param(1) {
+		case "=":
+			return rankExact, dir.Param(2)
+		case "^~":
+			return rankPrefixNoRegexp, dir.Param(2)
+		case "~", "~*":
+			return rankRegexp, ""
+		}
+	}
+	return rankPrefix, dir.Param(1)
+}
+
+// locationMatcher returns the matchers of the top-level location directive dir, which mustn't be
+// a named location.
+func locationMatcher(dir Directive) (map[string]caddyhttp.RequestMatcher, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	matchConfMap := make(map[string]caddyhttp.RequestMatcher)
+	if len(dir.Params) > 2 {
+		switch dir.Param(1) {
+		case "=":
+			matchConfMap["path"] = caddyhttp.MatchPath(dir.Params[2:])
+		case "~", "~*":
+			pattern := dir.Param(2)
+			if dir.Param(1) == "~*" {
+				pattern = "(?i)" + pattern // case-insensitive matching
+			}
+			matchConfMap["path_regexp"] = caddyhttp.MatchPathRE{
+				MatchRegexp: nginxRegexp("location", pattern),
+			}
+		case "^~":
+			matchConfMap["path"] = caddyhttp.MatchPath([]string{dir.Param(2) + "*"})
+			warns = append(warns, caddyconfig.Warning{
+				File:      dir.File,
+				Line:      dir.Line,
+				Directive: dir.Name(),
+				Message:   "the adapter tries the ^~ locations ahead of the regexp locations, even when a longer prefix location matches",
+			})
+		}
+	} else if len(dir.Params) == 2 { // only path
+		// append wild character because nginx treat naked path matchers as prefix matchers
+		matchConfMap["path"] = caddyhttp.MatchPath([]string{dir.Param(1) + "*"})
+	}
+	return matchConfMap, warns
+}
+
+// selectLocation returns the top-level location of the server block that nginx selects for the
+// request path p, if any: the location matching p exactly, or else the longest matching prefix if
+// it's marked with `^~`, or else the first matching regexp, or else the longest matching prefix.
+func (ss *setupState) selectLocation(p string) (Directive, bool) {
+	var longest Directive
+	var longestPrefix string
+	var longestRank int
+	var found bool
+	for _, loc := range ss.serverLocations {
+		rank, prefix := locationRank(loc)
+		switch rank {
+		case rankExact:
+			if prefix == p {
+				return loc, true
+			}
+		case rankPrefixNoRegexp, rankPrefix:
+			if strings.HasPrefix(p, prefix) && (!found || len(prefix) > len(longestPrefix)) {
+				longest, longestPrefix, longestRank, found = loc, prefix, rank, true
+			}
+		}
+	}
+	if found && longestRank == rankPrefixNoRegexp {
+		return longest, true
+	}
+	for _, loc := range ss.serverLocations {
+		if rank, _ := locationRank(loc); rank != rankRegexp {
+			continue
+		}
+		pattern := nginxRegexp("location", loc.Param(2)).Pattern
+		if loc.Param(1) == "~*" {
+			pattern = "(?i)" + pattern
+		}
+		if re, err := regexp.Compile(pattern); err == nil && re.MatchString(p) {
+			return loc, true
+		}
+	}
+	return longest, found
+}
+
+// fallbackLocation returns the routes of the location a request is redirected to internally by
+// nginx when given uri, e.g. the front controller `/index.php?$query_string` of `try_files`. Caddy
+// doesn't select the routes again once the URI is rewritten, so the location is converted in place.
+// It returns nil if the path of uri is only known at runtime or the location is being converted.
+func (ss *setupState) fallbackLocation(uri string) caddyhttp.RouteList {
+	p, _, _ := strings.Cut(uri, "?")
+	p = strings.TrimSuffix(p, "$is_args$args")
+	p = strings.TrimSuffix(p, "$is_args$query_string")
+	if !strings.HasPrefix(p, "/") || strings.Contains(p, "$") {
+		return nil
+	}
+	loc, ok := ss.selectLocation(p)
+	if !ok || ss.expanding[locationKey(loc)] {
+		return nil
+	}
+	// the warnings are reported where the location is converted in the first place
+	matcher, _ := locationMatcher(loc)
+	done := ss.expand(loc)
+	defer done()
+	routes, _, err := ss.locationContext(matcher, loc.Block)
+	if err != nil {
+		return nil
+	}
+	return routes
+}
+
+// locationKey identifies the location directive dir among the locations being expanded.
+func locationKey(dir Directive) string {
+	return fmt.Sprintf("%s:%d", dir.File, dir.Line)
+}
+
+// expand marks the top-level location directive dir as being converted, until the returned
+// function is called, so the locations falling back to it don't expand it again. Meanwhile the
+// requests denied get the forbidden page of the server block and the proxy directives are those
+// of the server block, even when the location is expanded in place of the fallback of another
+// one with its own.
+func (ss *setupState) expand(dir Directive) func() {
+	if ss.expanding == nil {
+		ss.expanding = make(map[string]bool)
+	}
+	key := locationKey(dir)
+	ss.expanding[key] = true
+	outer, outerProxy := ss.forbiddenPage, ss.proxySettings
+	ss.forbiddenPage, ss.proxySettings = ss.serverForbiddenPage, ss.serverProxySettings
+	return func() {
+		delete(ss.expanding, key)
+		ss.forbiddenPage, ss.proxySettings = outer, outerProxy
+	}
+}
+
 // locationContext processes the `location` directive in isolation from its surrounding
-// expecting the caller to handle it as `subroute`
+// expecting the caller to handle it as `subroute`. Nested locations become subroutes of the
+// returned route, so they only match requests also matched by rootMatcher.
 func (ss *setupState) locationContext(rootMatcher map[string]caddyhttp.RequestMatcher, dirs []Directive) (caddyhttp.RouteList, []caddyconfig.Warning, error) {
 	var warnings []caddyconfig.Warning
 	var handlers []json.RawMessage
 
-	currentMatcherSet := []map[string]caddyhttp.RequestMatcher{rootMatcher}
+	currentMatcher := make(map[string]caddyhttp.RequestMatcher, len(rootMatcher))
+	for k, v := range rootMatcher {
+		currentMatcher[k] = v
+	}
+	// the `allow` and `deny` directives of the location, converted together as the first of them
+	// matching the client decides
+	var accessRules *caddyhttp.Subroute
+
+	// the captures of a regexp location are referenced by the directives within
+	var captures captureVars
+	if m, ok := rootMatcher["path_regexp"].(caddyhttp.MatchPathRE); ok {
+		captures = captures.with(m.MatchRegexp)
+	}
+
+	// once a `break` is (possibly) executed, the rewrite-phase directives following it
+	// are guarded so they're skipped at runtime.
+	ss.locations++
+	breakVar := locationBreakVar + "_" + strconv.Itoa(ss.locations)
+	var breakSeen bool
+	rewritePhase := func(h json.RawMessage, warns *[]caddyconfig.Warning) json.RawMessage {
+		if !breakSeen {
+			return h
+		}
+		return guardBreak([]json.RawMessage{h}, breakVar, warns)
+	}
+
+	if dir, found := getDirective(dirs, "default_type"); found {
+		defer func(outer string) { ss.defaultType = outer }(ss.defaultType)
+		ss.defaultType = dir.Param(1)
+	}
+
+	// the proxy directives of the enclosing scope apply unless the location has its own
+	defer func(outer []Directive) { ss.proxySettings = outer }(ss.proxySettings)
+	ss.proxySettings = inheritProxySettings(ss.proxySettings, dirs)
+
+	// the page of `error_page 403` is served to the requests denied in the location
+	defer func(outer []json.RawMessage) { ss.forbiddenPage = outer }(ss.forbiddenPage)
+	for _, dir := range getAllDirectives(dirs, "error_page") {
+		root := ss.serverRoot
+		if rootDir, found := getDirective(dirs, "root"); found {
+			root = rootDir.Param(1)
+		}
+		hs, w := processForbiddenPage(dir, root)
+		warnings = append(warnings, w...)
+		if hs != nil {
+			ss.forbiddenPage = hs
+		}
+	}
+
+	// with `try_files`, the files are served by the handler trying them, which has to run
+	// before the content handlers starting at contentStart, e.g. `proxy_pass`
+	tryFilesDir, tryingFiles := getDirective(dirs, "try_files")
+	contentStart := -1
+	markContent := func() {
+		if contentStart < 0 {
+			contentStart = len(handlers)
+		}
+	}
+	// the access rules also apply to the nested locations, starting at nestedStart
+	nestedStart := -1
+
+	// the long runs of `rewrite` directives redirecting single paths are converted at once, the
+	// directives up to the end of the run being skipped
+	redirectRuns := literalRedirectRuns(dirs)
+	var skipUntil int
 
 nextDirective:
-	for _, dir := range dirs {
+	for i, dir := range dirs {
+		if i < skipUntil {
+			continue
+		}
 		var warns []caddyconfig.Warning
 
 		switch dir.Name() {
@@ -31,13 +250,11 @@ nextDirective:
 					matchConfMap["path"] = caddyhttp.MatchPath(dir.Params[2:])
 				case "~", "~*": // treat both as regexp matchers
 					pattern := dir.Param(2)
-					if strings.HasSuffix(pattern, "*") {
+					if dir.Param(1) == "~*" {
 						pattern = "(?i)" + pattern // case-insensitive matching
 					}
 					matchConfMap["path_regexp"] = caddyhttp.MatchPathRE{
-						MatchRegexp: caddyhttp.MatchRegexp{
-							Pattern: pattern,
-						},
+						MatchRegexp: nginxRegexp("location", pattern),
 					}
 				case "^~":
 					/*
@@ -74,6 +291,15 @@ nextDirective:
 				}
 				matchConfMap["path"] = caddyhttp.MatchPath([]string{p})
 			}
+			if msg := nestingError(rootMatcher, matchConfMap); msg != "" {
+				warnings = append(warnings, caddyconfig.Warning{
+					File:      dir.File,
+					Line:      dir.Line,
+					Directive: dir.Name(),
+					Message:   msg,
+				})
+				continue nextDirective
+			}
 			subsubroutes, warns, err := ss.locationContext(matchConfMap, dir.Block)
 			if err != nil || len(subsubroutes) == 0 {
 				warnings = append(warnings, warns...)
@@ -82,6 +308,9 @@ nextDirective:
 			h := caddyhttp.Subroute{
 				Routes: subsubroutes,
 			}
+			if nestedStart < 0 {
+				nestedStart = len(handlers)
+			}
 			handlers = append(handlers, caddyconfig.JSONModuleObject(h, "handler", "subroute", &warns))
 		case "if":
 			matcher, w := calculateIfMatcher(dir)
@@ -89,7 +318,7 @@ nextDirective:
 			if matcher == nil { // warning of failures already appended
 				continue nextDirective
 			}
-			h, w := ss.ifInLocationContext(dir.Block)
+			h, w := ss.ifInLocationContext(dir.Block, breakVar)
 			warns = append(warns, w...)
 			sroute := caddyhttp.Subroute{
 				Routes: []caddyhttp.Route{
@@ -99,74 +328,220 @@ nextDirective:
 					},
 				},
 			}
-			handlers = append(handlers, caddyconfig.JSONModuleObject(sroute, "handler", "subroute", &warns))
+			handlers = append(handlers, rewritePhase(caddyconfig.JSONModuleObject(sroute, "handler", "subroute", &warns), &warns))
+			breakSeen = breakSeen || ifBreaks(dir.Block)
+		case "break":
+			handlers = append(handlers, rewritePhase(breakHandler(breakVar, &warns), &warns))
+			breakSeen = true
 		case "root":
+			if tryingFiles {
+				continue nextDirective
+			}
+			markContent()
 			fileServer := fileserver.FileServer{
 				Root: dir.Param(1),
 				// TODO: all remaining fields...
 			}
 			handlers = append(handlers, caddyconfig.JSONModuleObject(fileServer, "handler", "file_server", &warns))
 		case "add_header":
-			hdr, w := processAddHeader(dir)
+			hdr, w := processAddHeader(dir, dirs)
 			warns = append(warns, w...)
 			handlers = append(handlers, caddyconfig.JSONModuleObject(hdr, "handler", "headers", &warns))
-		case "deny":
-			h, w := processDeny(dir)
+		case "allow", "deny":
+			if accessRules != nil {
+				continue // all of the location's rules are converted together
+			}
+			h, w := processAccessRules(dirs, ss.deniedHandlers(&warns))
 			warns = append(warns, w...)
-			handlers = append(handlers, caddyconfig.JSONModuleObject(h, "handler", "subroute", &warns))
-		case "allow":
-			currentMatcherSet = append(currentMatcherSet, processAllow(dir))
+			if h == nil {
+				h = new(caddyhttp.Subroute) // no valid rule, nothing to convert again
+			}
+			accessRules = h
 		case "rewrite":
-			h, w := processRewrite(dir)
+			if end, ok := redirectRuns[i]; ok {
+				hs, w := processRedirectRun(dirs[i:end])
+				warns = append(warns, w...)
+				if breakSeen {
+					hs = []json.RawMessage{guardBreak(hs, breakVar, &warns)}
+				}
+				handlers = append(handlers, hs...)
+				skipUntil = end
+				break
+			}
+			h, w := processRewrite(dir, breakVar, captures)
 			warns = append(warns, w...)
+			if dir.Param(3) == "last" {
+				// nginx selects the location of the rewritten URI, which Caddy doesn't do once
+				// the location is matched, so the location is expanded in place when known
+				if routes := ss.fallbackLocation(dir.Param(2)); routes != nil {
+					h.Routes[0].HandlersRaw = append(h.Routes[0].HandlersRaw, caddyconfig.JSONModuleObject(caddyhttp.Subroute{Routes: routes}, "handler", "subroute", &warns))
+				} else {
+					warns = append(warns, caddyconfig.Warning{
+						File:      dir.File,
+						Line:      dir.Line,
+						Directive: dir.Name(),
+						Message:   "the location of the URI rewritten with the last flag isn't selected again, as the URI is only known at runtime or selects this location; the rewritten URI is served by this location as with the break flag",
+					})
+				}
+			}
 			encodedHandler := caddyconfig.JSONModuleObject(h, "handler", "subroute", &warns)
-			handlers = append(handlers, encodedHandler)
+			handlers = append(handlers, rewritePhase(encodedHandler, &warns))
+			breakSeen = breakSeen || rewriteBreaks(dir)
 		case "fastcgi_split_path_info", "fastcgi_index": // only processed if fastcgi_pass is available, so don't react to them here.
+		case "try_files": // processed once the content handlers are known
+		case "slice":
+			warns = append(warns, caddyconfig.Warning{
+				File:      dir.File,
+				Line:      dir.Line,
+				Directive: dir.Name(),
+				Message:   ErrSlice,
+			})
+		case "proxy_cache_use_stale", "proxy_cache_lock", "proxy_cache_background_update":
+			// to be mapped to the stale-serving and locking options of the cache handler once
+			// the cache configuration is generated
+			warns = append(warns, caddyconfig.Warning{
+				File:      dir.File,
+				Line:      dir.Line,
+				Directive: dir.Name(),
+				Message:   ErrNoCache,
+			})
+		case "default_type": // in effect for the whole location
+		case "error_page": // in effect for the whole location
+		case "post_action":
+			warns = append(warns, processPostAction(dir)...)
 		case "fastcgi_pass":
+			markContent()
 			supportedDirectives := []string{"fastcgi_split_path_info", "fastcgi_index"}
 			fcgiDirs := []Directive{dir}
 			for _, v := range supportedDirectives {
 				fcgiDirs = append(fcgiDirs, getAllDirectives(dirs, v)...)
 			}
-			h, w := processFastCGIPass(fcgiDirs)
+			h, w := processFastCGIPass(fcgiDirs, ss.upstreams)
 			warns = append(warns, w...)
 			handlers = append(handlers, caddyconfig.JSONModuleObject(h, "handler", "subroute", &warns))
+		case "proxy_pass_request_headers", "proxy_ignore_headers", "proxy_set_header": // only processed if proxy_pass is available, so don't react to them here.
 		case "proxy_pass":
-			h, w := processProxyPass(dir, ss.upstreams)
+			markContent()
+			h, w := processProxyPass(append([]Directive{dir}, ss.proxySettings...), ss.upstreams)
 			warns = append(warns, w...)
 			handlers = append(handlers, caddyconfig.JSONModuleObject(h, "handler", "reverse_proxy", &warns))
-		case "expires":
-			hdr, w := processExpires(dir)
+		case "client_max_body_size":
+			h, w := processClientMaxBodySize(dir)
 			warns = append(warns, w...)
-			if hdr != nil {
-				handlers = append(handlers, caddyconfig.JSONModuleObject(hdr, "handler", "headers", &warns))
+			if h != nil {
+				// the limit has to be in place before any handler reads the body
+				handlers = append([]json.RawMessage{caddyconfig.JSONModuleObject(h, "handler", "request_body", &warns)}, handlers...)
+			}
+		case "expires":
+			if strings.HasPrefix(dir.Param(1), "$") {
+				hdrs, w := processExpiresMap(dir, ss.maps)
+				warns = append(warns, w...)
+				for _, hdr := range hdrs {
+					handlers = append(handlers, caddyconfig.JSONModuleObject(hdr, "handler", "headers", &warns))
+				}
+			} else {
+				hdr, w := processExpires(dir)
+				warns = append(warns, w...)
+				if hdr != nil {
+					handlers = append(handlers, caddyconfig.JSONModuleObject(hdr, "handler", "headers", &warns))
+				}
 			}
 		case "return":
-			h, w := processReturn(dir)
+			dir.Params = append([]string{}, dir.Params...)
+			for i := 2; i < len(dir.Params); i++ {
+				dir.Params[i] = captures.replace(dir.Params[i])
+			}
+			h, w := processReturn(dir, ss.defaultType)
 			warns = append(warns, w...)
 			encodedHandler := caddyconfig.JSONModuleObject(h, "handler", "static_response", &warns)
-			handlers = append(handlers, encodedHandler)
+			handlers = append(handlers, rewritePhase(encodedHandler, &warns))
 		default:
+			if w, ok := ss.proxySSLNotice(dir); ok {
+				warns = append(warns, w...)
+				break
+			}
 			warns = append(warns, caddyconfig.Warning{
 				File:      dir.File,
 				Line:      dir.Line,
 				Directive: dir.Name(),
-				Message:   ErrUnrecognized,
+				Message:   unrecognizedMessage(dir),
 			})
 		}
 		warnings = append(warnings, warns...)
 	}
 
+	// the access phase of nginx runs after the rewrite phase and before the content is served, by
+	// this location or the nested ones
+	if accessRules != nil && len(accessRules.Routes) > 0 {
+		encodedHandler := caddyconfig.JSONModuleObject(accessRules, "handler", "subroute", &warnings)
+		at := contentStart
+		if at < 0 || (nestedStart >= 0 && nestedStart < at) {
+			at = nestedStart
+		}
+		if at < 0 {
+			handlers = append(handlers, encodedHandler)
+		} else {
+			handlers = append(handlers[:at], append([]json.RawMessage{encodedHandler}, handlers[at:]...)...)
+			if contentStart >= at {
+				contentStart++
+			}
+		}
+	}
+
+	if tryingFiles {
+		root := ss.serverRoot
+		if rootDir, found := getDirective(dirs, "root"); found {
+			root = rootDir.Param(1)
+		}
+		h, w := ss.processTryFiles(tryFilesDir, root)
+		warnings = append(warnings, w...)
+		if h != nil {
+			encodedHandler := caddyconfig.JSONModuleObject(h, "handler", "subroute", &warnings)
+			if contentStart < 0 {
+				handlers = append(handlers, encodedHandler)
+			} else {
+				handlers = append(handlers[:contentStart], append([]json.RawMessage{encodedHandler}, handlers[contentStart:]...)...)
+			}
+		}
+	}
+
 	r := caddyhttp.Route{}
 	var err error
-	// set the matcher to route here so the `allow` and `deny` directives get to append their
-	// filters if used
-	r.MatcherSetsRaw, err = encodeMatcherSets(currentMatcherSet)
-	if err != nil {
-		// TODO:
-		return caddyhttp.RouteList{r}, warnings, err
+	// named locations have no matcher of their own
+	if len(currentMatcher) > 0 {
+		r.MatcherSetsRaw, err = encodeMatcherSets([]map[string]caddyhttp.RequestMatcher{currentMatcher})
+		if err != nil {
+			// TODO:
+			return caddyhttp.RouteList{r}, warnings, err
+		}
 	}
 	r.HandlersRaw = handlers
 
 	return caddyhttp.RouteList{r}, warnings, nil
 }
+
+// nestingError returns the reason the location matched by child can't be nested in the location
+// matched by parent, as nginx rejects it, or an empty string if it can. A prefix location has to
+// be within the prefix of its parent, and exact locations can't have nested locations.
+func nestingError(parent, child map[string]caddyhttp.RequestMatcher) string {
+	parentPaths, ok := parent["path"].(caddyhttp.MatchPath)
+	if !ok || len(parentPaths) == 0 {
+		return ""
+	}
+	parentPath := parentPaths[0]
+	if !strings.HasSuffix(parentPath, "*") {
+		return "locations can't be nested in the exact location " + parentPath
+	}
+	childPaths, ok := child["path"].(caddyhttp.MatchPath)
+	if !ok {
+		// regexp locations may be nested anywhere, the parent path still applies
+		return ""
+	}
+	prefix := strings.TrimSuffix(parentPath, "*")
+	for _, p := range childPaths {
+		if !strings.HasPrefix(p, prefix) {
+			return "location " + strings.TrimSuffix(p, "*") + " is outside the location " + prefix
+		}
+	}
+	return ""
+}
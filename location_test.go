@@ -0,0 +1,239 @@
+package nginxconf
+
+import "testing"
+
+func TestNestedLocations(t *testing.T) {
+	runAdaptTests(t, []adaptTest{
+		{
+			name: "nested regexp within the prefix of its parent",
+			conf: `http {
+				server {
+					listen 80;
+					location /api/ {
+						location ~ \.json$ {
+							return 200 json;
+						}
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.match":                                     `[{"path":["/api/*"]}]`,
+				"server_0.routes.0.handle.0.routes.0.match":                   `[{"path":["/api/*"]}]`,
+				"server_0.routes.0.handle.0.routes.0.handle.0.routes.0.match": `[{"path_regexp":{"name":"location","pattern":"\\.json$"}}]`,
+			},
+		},
+		{
+			name: "nested prefix within the prefix of its parent",
+			conf: `http {
+				server {
+					listen 80;
+					location /api/ {
+						location /api/v2/ {
+							return 200 v2;
+						}
+						return 200 api;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.handle.0.routes.0.handle.0.routes.0.match": `[{"path":["/api/v2/*"]}]`,
+				"server_0.routes.0.handle.0.routes.0.handle.1.handler":        `"static_response"`,
+			},
+		},
+		{
+			name: "nested location outside the prefix of its parent",
+			conf: `http {
+				server {
+					listen 80;
+					location /api/ {
+						location /admin/ {
+							return 200 admin;
+						}
+						return 200 api;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.handle.0.routes.0.handle.0.handler": `"static_response"`,
+				"server_0.routes.0.handle.0.routes.0.handle.1":         "",
+			},
+			warnings: []string{"location /admin/ is outside the location /api/"},
+		},
+		{
+			name: "nested location in an exact location",
+			conf: `http {
+				server {
+					listen 80;
+					location = /exact {
+						location /exact/x {
+							return 200 x;
+						}
+						return 200 exact;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.match":                              `[{"path":["/exact"]}]`,
+				"server_0.routes.0.handle.0.routes.0.handle.0.handler": `"static_response"`,
+				"server_0.routes.0.handle.0.routes.0.handle.1":         "",
+			},
+			warnings: []string{"locations can't be nested in the exact location /exact"},
+		},
+	})
+}
+
+func TestLocationOrder(t *testing.T) {
+	runAdaptTests(t, []adaptTest{
+		{
+			name: "regexps ahead of the prefixes and the root last",
+			conf: `http {
+				server {
+					listen 80;
+					root /srv/www;
+					location / {
+						try_files $uri /index.php?$query_string;
+					}
+					location /static/ {
+						return 200 static;
+					}
+					location ~ \.php$ {
+						fastcgi_pass 127.0.0.1:9000;
+					}
+					location = /health {
+						return 200 ok;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.match": `[{"path":["/health"]}]`,
+				"server_0.routes.1.match": `[{"path_regexp":{"name":"location","pattern":"\\.php$"}}]`,
+				"server_0.routes.2.match": `[{"path":["/static/*"]}]`,
+				"server_0.routes.3.match": `[{"path":["/*"]}]`,
+				// the front controller is selected in place, as Caddy doesn't select the
+				// locations again once the URI is rewritten
+				"server_0.routes.3.handle.0.routes.0.handle.0.routes.1.handle.1.routes.0.match": `[{"path_regexp":{"name":"location","pattern":"\\.php$"}}]`,
+				"server_0.routes.4.match":    "",
+				"server_0.routes.4.handle.0": `{"handler":"file_server","root":"/srv/www"}`,
+			},
+		},
+		{
+			name: "named location falling back to itself",
+			conf: `http {
+				server {
+					listen 80;
+					location / {
+						try_files $uri @app;
+					}
+					location @app {
+						try_files $uri.html @app;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.handle.0.routes.0.handle.0.routes.1.handle.0.routes.0.handle.0.routes.0.handle.0.handler": `"rewrite"`,
+				"server_0.routes.0.handle.0.routes.0.handle.0.routes.1.handle.0.routes.0.handle.0.routes.1":                  "",
+			},
+			warnings: []string{"the named location @app falls back to itself, through try_files; the fallback is ignored"},
+		},
+	})
+}
+
+func TestLocationAccessRules(t *testing.T) {
+	runAdaptTests(t, []adaptTest{
+		{
+			name: "first matching rule decides, ahead of the content",
+			conf: `http {
+				server {
+					listen 80;
+					location /admin/ {
+						deny 10.0.0.1;
+						allow 10.0.0.0/8;
+						deny all;
+						proxy_pass http://127.0.0.1:8080;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.handle.0.routes.0.handle.0.routes.0": `{"handle":[{"handler":"static_response","status_code":403}],"match":[{"remote_ip":{"ranges":["10.0.0.1/32"]}}],"terminal":true}`,
+				"server_0.routes.0.handle.0.routes.0.handle.0.routes.1": `{"match":[{"remote_ip":{"ranges":["10.0.0.0/8"]}}],"terminal":true}`,
+				"server_0.routes.0.handle.0.routes.0.handle.0.routes.2": `{"handle":[{"handler":"static_response","status_code":403}],"match":[{"remote_ip":{"ranges":["0.0.0.0/0","::/0"]}},{"not":[{"remote_ip":{"ranges":["0.0.0.0/0","::/0"]}}]}],"terminal":true}`,
+				"server_0.routes.0.handle.0.routes.0.handle.1.handler":  `"reverse_proxy"`,
+			},
+		},
+		{
+			name: "rules applying to the nested locations",
+			conf: `http {
+				server {
+					listen 80;
+					location /admin/ {
+						location ~ \.php$ {
+							fastcgi_pass 127.0.0.1:9000;
+						}
+						allow 10.0.0.0/8;
+						deny all;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.handle.0.routes.0.handle.0.routes.0.match": `[{"remote_ip":{"ranges":["10.0.0.0/8"]}}]`,
+				"server_0.routes.0.handle.0.routes.0.handle.1.routes.0.match": `[{"path_regexp":{"name":"location","pattern":"\\.php$"}}]`,
+			},
+		},
+	})
+}
+
+func TestLocationBreak(t *testing.T) {
+	runAdaptTests(t, []adaptTest{
+		{
+			name: "break of each location",
+			conf: `http {
+				server {
+					listen 80;
+					location /first/ {
+						break;
+						rewrite ^/(.*)$ /x/$1;
+					}
+					location /second/ {
+						break;
+						rewrite ^/(.*)$ /y/$1;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.1.handle.0.routes.0.handle.0":                `{"handler":"vars","nginx_location_break_1":true}`,
+				"server_0.routes.0.handle.0.routes.0.handle.0":                `{"handler":"vars","nginx_location_break_2":true}`,
+				"server_0.routes.0.handle.0.routes.0.handle.1.routes.0.match": `[{"not":[{"vars":{"nginx_location_break_2":["true"]}}]}]`,
+			},
+		},
+		{
+			name: "rewrite selecting another location",
+			conf: `http {
+				server {
+					listen 80;
+					location /old/ {
+						rewrite ^ /new/ last;
+					}
+					location /new/ {
+						return 200 new;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.match": `[{"path":["/old/*"]}]`,
+				"server_0.routes.0.handle.0.routes.0.handle.0.routes.0.handle.2.routes.0.match": `[{"path":["/new/*"]}]`,
+			},
+		},
+		{
+			name: "rewrite to a URI known at runtime",
+			conf: `http {
+				server {
+					listen 80;
+					location /old/ {
+						rewrite ^/old/(.*)$ /new/$1 last;
+					}
+				}
+			}`,
+			warnings: []string{"the location of the URI rewritten with the last flag isn't selected again, as the URI is only known at runtime or selects this location; the rewritten URI is served by this location as with the break flag"},
+		},
+	})
+}
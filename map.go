@@ -0,0 +1,419 @@
+package nginxconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/headers"
+	maphandler "github.com/caddyserver/caddy/v2/modules/caddyhttp/map"
+)
+
+// largeMap is the number of entries from which a map is converted to a single map handler
+// rather than a route per value, keeping the config of large maps, e.g. of redirects, compact.
+const largeMap = 64
+
+// Map is the `map` block of the http context, which sets the variable Variable
+// depending on the value of Source.
+type Map struct {
+	Source   string
+	Variable string
+	Default  string
+	Entries  []MapEntry
+	// Hostnames tells the keys may be host names with a leading or trailing wildcard
+	Hostnames bool
+
+	File string
+	Line int
+}
+
+// MapEntry is a single line of a `map` block.
+type MapEntry struct {
+	Key             string
+	Value           string
+	Regexp          bool
+	CaseInsensitive bool
+
+	Line int
+}
+
+func (ss *setupState) mapContext(dir Directive) (Map, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	m := Map{
+		Source:   dir.Param(1),
+		Variable: dir.Param(2),
+		File:     dir.File,
+		Line:     dir.Line,
+	}
+	for _, entry := range dir.Block {
+		switch entry.Name() {
+		case "default":
+			m.Default = entry.Param(1)
+		case "hostnames":
+			m.Hostnames = true
+		case "volatile":
+			// the variables are computed for every request anyway
+		default:
+			e := MapEntry{
+				Key:   entry.Name(),
+				Value: entry.Param(1),
+				Line:  entry.Line,
+			}
+			switch {
+			case strings.HasPrefix(e.Key, "~*"):
+				e.Key, e.Regexp, e.CaseInsensitive = e.Key[2:], true, true
+			case strings.HasPrefix(e.Key, "~"):
+				e.Key, e.Regexp = e.Key[1:], true
+			case strings.HasPrefix(e.Key, `\`):
+				e.Key = e.Key[1:] // escaped leading character, e.g. `\default`
+			}
+			m.Entries = append(m.Entries, e)
+		}
+	}
+	return m, warns
+}
+
+// mapHandlers returns the handlers setting the variable of the map m depending on the value of
+// its source: a map handler looking up the entries, whose result is then stored in the variable.
+// Caddy checks the entries in order, so they're listed by precedence: the exact keys, then the
+// wildcard host names from the most specific, then the regexps.
+func mapHandlers(m Map) ([]json.RawMessage, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	name := strings.TrimPrefix(m.Variable, "$")
+	dest := "{nginx_map." + name + "}"
+	h := maphandler.Handler{
+		Source:       replaceNginxVars(m.Source),
+		Destinations: []string{dest},
+		Defaults:     []string{mapHandlerValue(m.Default)},
+	}
+
+	var wildcards, regexps []maphandler.Mapping
+	var wildcardKeys []string
+	seen := make(map[string]bool)
+	for _, e := range m.Entries {
+		value := mapHandlerValue(e.Value)
+		switch {
+		case e.Regexp:
+			pattern := nginxRegexp("", e.Key).Pattern
+			if e.CaseInsensitive {
+				pattern = "(?i)" + pattern
+			}
+			regexps = append(regexps, maphandler.Mapping{InputRegexp: pattern, Outputs: []interface{}{value}})
+		case m.Hostnames && (strings.HasPrefix(e.Key, ".") || strings.HasPrefix(e.Key, "*.") || strings.HasSuffix(e.Key, ".*")):
+			wildcardKeys = append(wildcardKeys, e.Key)
+			wildcards = append(wildcards, maphandler.Mapping{InputRegexp: hostWildcardPattern(e.Key), Outputs: []interface{}{value}})
+		case seen[e.Key]:
+			// the first entry of a key is the one used
+		default:
+			seen[e.Key] = true
+			h.Mappings = append(h.Mappings, maphandler.Mapping{Input: e.Key, Outputs: []interface{}{value}})
+		}
+	}
+	sort.Stable(wildcardsByPrecedence{wildcardKeys, wildcards})
+	h.Mappings = append(h.Mappings, wildcards...)
+	h.Mappings = append(h.Mappings, regexps...)
+
+	return []json.RawMessage{
+		caddyconfig.JSONModuleObject(h, "handler", "map", &warns),
+		caddyconfig.JSONModuleObject(caddyhttp.VarsMiddleware{name: dest}, "handler", "vars", &warns),
+	}, warns
+}
+
+// mapHandlerValue converts the nginx variables in the value of a map entry to Caddy
+// placeholders, except the references to the captures of the regexp keys, which the map
+// handler expands itself.
+func mapHandlerValue(value string) string {
+	return nginxVarRE.ReplaceAllStringFunc(value, func(v string) string {
+		ref := strings.Trim(v[1:], "{}")
+		if isNumeric(ref) {
+			return "${" + ref + "}"
+		}
+		return getCaddyVar("$" + ref)
+	})
+}
+
+// wildcardsByPrecedence sorts the wildcard host name mappings of a map handler as nginx prefers
+// them: the leading wildcards before the trailing ones, the longest first.
+type wildcardsByPrecedence struct {
+	keys     []string
+	mappings []maphandler.Mapping
+}
+
+func (w wildcardsByPrecedence) Len() int { return len(w.keys) }
+
+func (w wildcardsByPrecedence) Less(i, j int) bool {
+	iTrailing, jTrailing := strings.HasSuffix(w.keys[i], ".*"), strings.HasSuffix(w.keys[j], ".*")
+	if iTrailing != jTrailing {
+		return jTrailing
+	}
+	return len(w.keys[i]) > len(w.keys[j])
+}
+
+func (w wildcardsByPrecedence) Swap(i, j int) {
+	w.keys[i], w.keys[j] = w.keys[j], w.keys[i]
+	w.mappings[i], w.mappings[j] = w.mappings[j], w.mappings[i]
+}
+
+// mapCaptureRE matches the references to the captures of a regexp in the values of a map.
+var mapCaptureRE = regexp.MustCompile(`\$\{?(\d)\}?`)
+
+// mapSourceVar is the variable holding the value of the source of the map being computed by
+// mapRoutes, when it isn't a single placeholder.
+const mapSourceVar = "nginx_map_source"
+
+// mapRoutes returns the routes setting the variable of the map m depending on the value of its
+// source. The routes are ordered by increasing precedence, so the entry nginx would pick is the
+// last one applied: the default, then the regexps from the last to the first, then the wildcard
+// host names from the least specific, then the exact keys. The exact keys sharing a value are
+// matched by a single route.
+func mapRoutes(m Map) (caddyhttp.RouteList, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	name := strings.TrimPrefix(m.Variable, "$")
+	source := replaceNginxVars(m.Source)
+	set := func(value string) []json.RawMessage {
+		h := caddyhttp.VarsMiddleware{name: replaceNginxVars(value)}
+		return []json.RawMessage{caddyconfig.JSONModuleObject(h, "handler", "vars", &warns)}
+	}
+	matchRegexp := func(re *caddyhttp.MatchRegexp) caddy.ModuleMap {
+		return caddy.ModuleMap{
+			"vars_regexp": caddyconfig.JSON(caddyhttp.MatchVarsRE{source: re}, &warns),
+		}
+	}
+
+	var routes caddyhttp.RouteList
+	if strings.Count(source, "{") != 1 || !strings.HasPrefix(source, "{") || !strings.HasSuffix(source, "}") {
+		// the matchers only look up a single placeholder, so a source made of several variables
+		// or text, e.g. `$host$uri`, is stored in a variable of its own first
+		h := caddyhttp.VarsMiddleware{mapSourceVar: source}
+		routes = append(routes, caddyhttp.Route{
+			HandlersRaw: []json.RawMessage{caddyconfig.JSONModuleObject(h, "handler", "vars", &warns)},
+		})
+		source = mapSourceVar
+	}
+	if m.Default != "" {
+		routes = append(routes, caddyhttp.Route{HandlersRaw: set(m.Default)})
+	}
+
+	var exact, wildcards, regexps []MapEntry
+	for _, e := range m.Entries {
+		switch {
+		case e.Regexp:
+			regexps = append(regexps, e)
+		case m.Hostnames && (strings.HasPrefix(e.Key, ".") || strings.HasPrefix(e.Key, "*.") || strings.HasSuffix(e.Key, ".*")):
+			wildcards = append(wildcards, e)
+		default:
+			exact = append(exact, e)
+		}
+	}
+
+	for i := len(regexps) - 1; i >= 0; i-- {
+		e := regexps[i]
+		pattern := e.Key
+		if e.CaseInsensitive {
+			pattern = "(?i)" + pattern
+		}
+		// the PCRE named captures are converted as in the map handlers
+		re := nginxRegexp(name, pattern)
+		value := mapCaptureRE.ReplaceAllString(e.Value, "{http.regexp."+name+".${1}}")
+		routes = append(routes, caddyhttp.Route{
+			MatcherSetsRaw: []caddy.ModuleMap{matchRegexp(&re)},
+			HandlersRaw:    set(value),
+		})
+	}
+
+	// nginx prefers the longest leading wildcard, then the longest trailing one
+	sort.SliceStable(wildcards, func(i, j int) bool {
+		iTrailing, jTrailing := strings.HasSuffix(wildcards[i].Key, ".*"), strings.HasSuffix(wildcards[j].Key, ".*")
+		if iTrailing != jTrailing {
+			return iTrailing
+		}
+		return len(wildcards[i].Key) < len(wildcards[j].Key)
+	})
+	for _, e := range wildcards {
+		routes = append(routes, caddyhttp.Route{
+			MatcherSetsRaw: []caddy.ModuleMap{matchRegexp(&caddyhttp.MatchRegexp{Pattern: hostWildcardPattern(e.Key)})},
+			HandlersRaw:    set(e.Value),
+		})
+	}
+
+	var values []string
+	keys := make(map[string][]string)
+	for _, e := range exact {
+		if _, ok := keys[e.Value]; !ok {
+			values = append(values, e.Value)
+		}
+		keys[e.Value] = append(keys[e.Value], e.Key)
+	}
+	for _, v := range values {
+		routes = append(routes, caddyhttp.Route{
+			MatcherSetsRaw: []caddy.ModuleMap{
+				{
+					"vars": caddyconfig.JSON(caddyhttp.VarsMatcher{source: keys[v]}, &warns),
+				},
+			},
+			HandlersRaw: set(v),
+		})
+	}
+	return routes, warns
+}
+
+// serverMaps returns the names of the maps whose variables the directives dirs reference, directly
+// or through the source and the values of other maps, each after the maps it references so their
+// variables are computed first. The maps of response header fields are only used by `expires`,
+// see processExpiresMap.
+func serverMaps(maps map[string]Map, dirs []Directive) []string {
+	var referenced []string
+	for name, m := range maps {
+		if !strings.HasPrefix(m.Source, "$sent_http_") && referencesVariable(dirs, strings.TrimPrefix(name, "$")) {
+			referenced = append(referenced, name)
+		}
+	}
+	sort.Strings(referenced)
+
+	var names []string
+	visited := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		m, ok := maps[name]
+		if !ok || visited[name] || strings.HasPrefix(m.Source, "$sent_http_") {
+			return
+		}
+		visited[name] = true
+		values := []string{m.Source, m.Default}
+		for _, e := range m.Entries {
+			values = append(values, e.Value)
+		}
+		for _, v := range values {
+			for _, ref := range nginxVarRE.FindAllStringSubmatch(v, -1) {
+				visit("$" + ref[1] + ref[2])
+			}
+		}
+		names = append(names, name)
+	}
+	for _, name := range referenced {
+		visit(name)
+	}
+	return names
+}
+
+// hostWildcardPattern returns the regexp matching the host names matched by a key of a map with
+// the `hostnames` parameter: `*.example.com` matches the subdomains of example.com, `.example.com`
+// matches example.com as well, and `www.example.*` matches any top-level part.
+func hostWildcardPattern(key string) string {
+	switch {
+	case strings.HasPrefix(key, "*."):
+		return `(?i)^.+\.` + regexp.QuoteMeta(key[2:]) + `$`
+	case strings.HasPrefix(key, "."):
+		return `(?i)^(.+\.)?` + regexp.QuoteMeta(key[1:]) + `$`
+	default:
+		return `(?i)^` + regexp.QuoteMeta(strings.TrimSuffix(key, "*")) + `.+$`
+	}
+}
+
+// processExpiresMap processes the `expires $var` directive whose variable is set by a map on the
+// response Content-Type, i.e. `map $sent_http_content_type $var { ... }`. It returns one headers handler
+// per map entry, each conditioned on the Content-Type of the response. The handlers are ordered by
+// precedence: exact matches first, then regexps in order of appearance, then the default. The response
+// header operations of the handler placed first in the chain are the last ones applied, so its value wins.
+func processExpiresMap(dir Directive, maps map[string]Map) ([]*headers.Handler, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	m, ok := maps[dir.Param(1)]
+	if !ok || m.Source != "$sent_http_content_type" {
+		warns = append(warns, caddyconfig.Warning{
+			File:      dir.File,
+			Line:      dir.Line,
+			Directive: dir.Name(),
+			Message:   "expires with a variable is only supported when set by a map of $sent_http_content_type",
+		})
+		return nil, warns
+	}
+
+	var exact, regexps []MapEntry
+	for _, e := range m.Entries {
+		if e.Regexp {
+			regexps = append(regexps, e)
+		} else {
+			exact = append(exact, e)
+		}
+	}
+
+	var hdrs []*headers.Handler
+	for _, e := range append(exact, regexps...) {
+		contentType := e.Key
+		if e.Regexp {
+			var ok bool
+			if contentType, ok = regexpToWildcard(e.Key, e.CaseInsensitive); !ok {
+				warns = append(warns, caddyconfig.Warning{
+					File:      m.File,
+					Line:      e.Line,
+					Directive: "map",
+					Message:   fmt.Sprintf("content type regexp can't be converted to a header matcher: %s", e.Key),
+				})
+				continue
+			}
+		}
+		if e.Value == "off" {
+			if m.Default != "" && m.Default != "off" {
+				warns = append(warns, caddyconfig.Warning{
+					File:      m.File,
+					Line:      e.Line,
+					Directive: "map",
+					Message:   fmt.Sprintf("responses of type %s will receive the default expiry instead of none", e.Key),
+				})
+			}
+			continue
+		}
+		hdr, w := processExpires(Directive{Params: []string{"expires", e.Value}, File: m.File, Line: e.Line})
+		warns = append(warns, w...)
+		if hdr == nil {
+			continue
+		}
+		hdr.Response.Require = &caddyhttp.ResponseMatcher{
+			Headers: http.Header{"Content-Type": []string{contentType}},
+		}
+		hdrs = append(hdrs, hdr)
+	}
+	if m.Default != "" {
+		hdr, w := processExpires(Directive{Params: []string{"expires", m.Default}, File: m.File, Line: m.Line})
+		warns = append(warns, w...)
+		if hdr != nil {
+			hdrs = append(hdrs, hdr)
+		}
+	}
+	return hdrs, warns
+}
+
+// regexpToWildcard converts a regexp which only matches a literal, optionally anchored, to the
+// equivalent header value pattern with `*` wildcards, e.g. `^image/` to `image/*`.
+func regexpToWildcard(pattern string, caseInsensitive bool) (string, bool) {
+	anchoredStart := strings.HasPrefix(pattern, "^")
+	anchoredEnd := strings.HasSuffix(pattern, "$") && !strings.HasSuffix(pattern, `\$`)
+	core := strings.TrimSuffix(strings.TrimPrefix(pattern, "^"), "$")
+	re, err := syntax.Parse(core, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpLiteral {
+		return "", false
+	}
+	lit := string(re.Rune)
+	if caseInsensitive {
+		// media types are conventionally lowercase
+		lit = strings.ToLower(lit)
+	}
+	if !anchoredStart {
+		lit = "*" + lit
+	}
+	if !anchoredEnd {
+		lit += "*"
+	}
+	return lit, true
+}
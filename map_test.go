@@ -0,0 +1,90 @@
+package nginxconf
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMapRoutes(t *testing.T) {
+	runAdaptTests(t, []adaptTest{
+		{
+			name: "named captures of the regexps",
+			conf: `http {
+				map $uri $lang {
+					default en;
+					~^/(?<code>[a-z][a-z])/ other;
+				}
+				server {
+					listen 80;
+					location / {
+						return 200 $lang;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.handle.0.routes.1.match": `[{"vars_regexp":{"{http.request.uri.path}":{"name":"lang","pattern":"^/(?P<code>[a-z][a-z])/"}}}]`,
+			},
+		},
+		{
+			name: "source made of several variables",
+			conf: `http {
+				map $host$uri $cached {
+					default 0;
+					example.com/a 1;
+				}
+				server {
+					listen 80;
+					location / {
+						return 200 $cached;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.handle.0.routes.0.handle.0": `{"handler":"vars","nginx_map_source":"{http.request.host}{http.request.uri.path}"}`,
+				"server_0.routes.0.handle.0.routes.2.match":    `[{"vars":{"nginx_map_source":["example.com/a"]}}]`,
+			},
+		},
+		{
+			name: "map sourced from another map",
+			conf: `http {
+				map $section $pool {
+					default web;
+					api api_pool;
+				}
+				map $uri $section {
+					default other;
+					~^/api/ api;
+				}
+				server {
+					listen 80;
+					location / {
+						return 200 $pool;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.handle.0.routes.1.match":    `[{"vars_regexp":{"{http.request.uri.path}":{"name":"section","pattern":"^/api/"}}}]`,
+				"server_0.routes.0.handle.0.routes.3.match":    `[{"vars":{"{http.vars.section}":["api"]}}]`,
+				"server_0.routes.0.handle.0.routes.3.handle.0": `{"handler":"vars","pool":"api_pool"}`,
+			},
+		},
+	})
+}
+
+func TestMapCoverage(t *testing.T) {
+	_, warnings := adapt(t, []byte(`http {
+		map $uri $section {
+			default main;
+			/blog blog;
+			/shop shop;
+		}
+		server {
+			listen 80;
+		}
+	}`), nil)
+	// the entries of the map aren't directives
+	const want = "coverage: 4 of 4 directives converted (100.0%)"
+	if !slices.Contains(warnings, want) {
+		t.Errorf("missing warning %q, got %q", want, warnings)
+	}
+}
@@ -17,7 +17,11 @@ package nginxconf
 import (
 	"encoding/json"
 	"fmt"
+	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -33,60 +37,256 @@ func init() {
 const ErrUnrecognized = "unrecognized or unsupported nginx directive"
 const ErrNamedLocation = "named locations marked by @ are unnsupported"
 const ErrExpiresAtTime = "usage of `expires @time` is not supported"
+const ErrNoCache = "proxy caching is not converted yet, so this cache setting is ignored"
+const ErrSlice = "Caddy has no segmented caching like the slice module, so responses are fetched and cached whole"
+const ErrOpenSSL = "OpenSSL-specific directive with no equivalent in Caddy, which uses Go's TLS stack; this and further uses are ignored"
 
 // Adapter adapts NGINX config to Caddy JSON.
 type Adapter struct{}
 
-// Adapt converts the NGINX config in body to Caddy JSON.
+// Adapt converts the NGINX config in body to Caddy JSON. The "prefix" option overrides the
+// directory of the nginx installation that included files are looked up in, and the "base"
+// option the directory that relative includes of single files are resolved against, the prefix
+// by default. With the "unsupported_metadata" option, the directives that couldn't be converted
+// are also recorded in the `_nginx_unsupported` key of the output. With the "name_servers"
+// option, the Caddy servers are named after the first name of their server block rather than
+// their position, so the names stay the same when the config is reordered. The "only_hosts"
+// option, a comma-separated list of server name patterns like `example.com,*.api.example.com`,
+// limits the adaptation to the server blocks with a matching name. With the "normalize" option,
+// the null and empty-array fields are left out of the output and the object keys are sorted,
+// the output being indented unless the "minify" option is set as well. With the "stamp" option,
+// the output is stamped with the adapter version and the checksum of the input files, see withStamp.
+// The options not given can be set by environment variables, see envOptions.
 func (Adapter) Adapt(body []byte, options map[string]interface{}) ([]byte, []caddyconfig.Warning, error) {
-	filename := "nginx.conf"
-	if v, ok := options["filename"].(string); ok {
-		filename = v
-		filename, _ = filepath.Abs(filename)
-	}
-	tokens := tokenize(body, filename)
-	dirs, err := parse(tokens)
+	options, err := withEnvOptions(options)
 	if err != nil {
-		return nil, nil, fmt.Errorf("parsing: %v", err)
-	}
-
-	ss := setupState{
-		servers: make(map[string]*caddyhttp.Server),
+		return nil, nil, err
 	}
-
-	warnings, err := ss.mainContext(dirs)
+	ss, dirs, warnings, err := convert(body, options)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	httpApp := caddyhttp.App{
-		Servers: ss.servers,
+		Servers:     ss.servers,
+		GracePeriod: ss.gracePeriod,
 	}
 
 	ss.mainConfig.AppsRaw = map[string]json.RawMessage{
 		"http": caddyconfig.JSON(httpApp, &warnings),
 	}
+	if ss.layer4 != nil {
+		ss.mainConfig.AppsRaw["layer4"] = caddyconfig.JSON(ss.layer4, &warnings)
+	}
 
-	result, err := json.Marshal(ss.mainConfig)
+	var result []byte
+	if v, ok := options["unsupported_metadata"].(bool); ok && v {
+		result, err = marshalWithUnsupported(ss.mainConfig, unsupportedDirectives(dirs, warnings))
+	} else {
+		result, err = json.Marshal(ss.mainConfig)
+	}
+	if v, ok := options["stamp"].(bool); ok && v && err == nil {
+		result, err = withStamp(result, ss.fingerprint)
+	}
+	if normalize, minify := normalizeOptions(options); normalize && err == nil {
+		result, err = normalizeJSON(result, minify)
+	}
 
 	return result, warnings, err
 }
 
+// convert parses the NGINX config in body and converts it given the adaptation options, returning
+// the state holding the converted servers, the parsed directives and the adaptation warnings.
+func convert(body []byte, options map[string]interface{}) (*setupState, []Directive, []caddyconfig.Warning, error) {
+	filename, layout := inputOptions(options)
+	parser := nginxParser{tokens: tokenize(body, filename), layout: layout}
+	dirs, err := parser.nextBlock()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("parsing: %v", err)
+	}
+
+	ss := &setupState{
+		servers:     make(map[string]*caddyhttp.Server),
+		fingerprint: parser.fingerprint(body),
+	}
+	if v, ok := options["name_servers"].(bool); ok {
+		ss.nameServers = v
+	}
+	switch v := options["only_hosts"].(type) {
+	case string:
+		for _, host := range strings.Split(v, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				ss.onlyHosts = append(ss.onlyHosts, host)
+			}
+		}
+	case []string:
+		ss.onlyHosts = v
+	}
+
+	warns, err := ss.mainContext(dirs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	warnings := append(parser.warnings, warns...)
+	// the summary is part of the warnings so it reaches the callers of the /adapt admin
+	// endpoint as well as the CLI
+	warnings = append(warnings, ss.summary(dirs, warnings)...)
+	return ss, dirs, warnings, nil
+}
+
+// inputOptions returns the name of the file being adapted and the layout of the nginx
+// installation given by the adaptation options.
+func inputOptions(options map[string]interface{}) (string, confLayout) {
+	filename := "nginx.conf"
+	if v, ok := options["filename"].(string); ok {
+		filename = v
+		filename, _ = filepath.Abs(filename)
+	}
+	layout := defaultConfLayout()
+	if v, ok := options["prefix"].(string); ok && v != "" {
+		layout.prefix = v
+		layout.base = v
+	}
+	if v, ok := options["base"].(string); ok && v != "" {
+		layout.base = v
+	}
+	return filename, layout
+}
+
+// envOptions are the environment variables setting adaptation options, by the option they set,
+// for the commands running the adapter without a way to give it options, such as `caddy adapt`
+// and `caddy run --adapter nginx`.
+var envOptions = map[string]string{
+	"only_hosts":           "NGINX_ADAPTER_ONLY_HOSTS",
+	"normalize":            "NGINX_ADAPTER_NORMALIZE",
+	"minify":               "NGINX_ADAPTER_MINIFY",
+	"stamp":                "NGINX_ADAPTER_STAMP",
+	"unsupported_metadata": "NGINX_ADAPTER_UNSUPPORTED_METADATA",
+}
+
+// withEnvOptions returns a copy of the adaptation options along with the options set by the
+// environment variables of envOptions, the options given taking precedence. The variables of the
+// boolean options take the values of strconv.ParseBool.
+func withEnvOptions(options map[string]interface{}) (map[string]interface{}, error) {
+	opts := make(map[string]interface{}, len(options))
+	for k, v := range options {
+		opts[k] = v
+	}
+	for name, env := range envOptions {
+		value, ok := os.LookupEnv(env)
+		if _, given := opts[name]; given || !ok {
+			continue
+		}
+		if name == "only_hosts" {
+			opts[name] = value
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", env, err)
+		}
+		opts[name] = b
+	}
+	return opts, nil
+}
+
 type setupState struct {
 	mainConfig caddy.Config
 	servers    map[string]*caddyhttp.Server
 
 	upstreams map[string]Upstream
+	maps      map[string]Map
+
+	// the layer4 app the servers of the stream context are converted to, if any
+	layer4 *l4App
+
+	// the DNS configuration of the http context
+	resolver Resolver
+
+	// the OpenSSL-specific directives already reported
+	openSSLNoticed map[string]bool
+
+	// whether the servers are named after their first server name
+	nameServers bool
+
+	// the patterns of the server names to adapt the server blocks of, all of them if empty
+	onlyHosts []string
+
+	// the time given to connections to finish on shutdown, by `worker_shutdown_timeout`
+	gracePeriod caddy.Duration
+
+	// the root and the named locations of the server block being converted, which its
+	// locations refer to
+	serverRoot     string
+	namedLocations map[string]Directive
+
+	// the other top-level locations of the server block being converted, which the URIs the
+	// requests are redirected to internally are matched against
+	serverLocations []Directive
+
+	// the locations being converted, by locationKey, which the locations they fall back to
+	// mustn't expand again
+	expanding map[string]bool
+
+	// the number of locations converted so far, numbering the variables tracking the `break` of
+	// each location, see locationBreakVar
+	locations int
+
+	// the `default_type` of the http context, and the one in effect in the scope being converted
+	httpDefaultType string
+	defaultType     string
+
+	// the handlers of the requests denied by `allow` and `deny` in the server block and in the
+	// scope being converted, a bare 403 response if nil
+	serverForbiddenPage []json.RawMessage
+	forbiddenPage       []json.RawMessage
+
+	// the directives of proxyPassDirectives in effect in the http context, the server block and
+	// the scope being converted, see inheritProxySettings
+	httpProxySettings   []Directive
+	serverProxySettings []Directive
+	proxySettings       []Directive
+
+	// the checksum of the adapted config and the files it includes, see nginxParser.fingerprint
+	fingerprint string
 }
 
 func (ss *setupState) mainContext(dirs []Directive) ([]caddyconfig.Warning, error) {
-	var warnings []caddyconfig.Warning
+	dirs, warnings := checkArity(dirs)
 	for _, dir := range dirs {
 		var warns []caddyconfig.Warning
 		var err error
 		switch dir.Name() {
 		case "http":
 			warns, err = ss.httpContext(dir.Block)
+		case "stream":
+			warns, err = ss.streamContext(dir.Block)
+		case "ssl_engine":
+			warns = ss.openSSLNotice(dir)
+		case "worker_processes", "worker_rlimit_nofile":
+			warns = []caddyconfig.Warning{
+				{
+					File:      dir.File,
+					Line:      dir.Line,
+					Directive: dir.Name(),
+					Message:   workerNotes[dir.Name()],
+				},
+			}
+		case "events":
+			workers, _ := getDirective(dirs, "worker_processes")
+			warns = processEvents(dir, workers)
+		case "worker_shutdown_timeout":
+			d, err := parseNginxDuration(dir.Param(1))
+			if err != nil {
+				warns = append(warns, caddyconfig.Warning{
+					File:      dir.File,
+					Line:      dir.Line,
+					Directive: dir.Name(),
+					Message:   err.Error(),
+				})
+				break
+			}
+			ss.gracePeriod = caddy.Duration(d)
 		default:
 			warns = []caddyconfig.Warning{
 				{
@@ -107,10 +307,35 @@ func (ss *setupState) mainContext(dirs []Directive) ([]caddyconfig.Warning, erro
 
 func (ss *setupState) httpContext(dirs []Directive) ([]caddyconfig.Warning, error) {
 	var warnings []caddyconfig.Warning
+	if dir, found := getDirective(dirs, "default_type"); found {
+		ss.httpDefaultType = dir.Param(1)
+	}
+	ss.httpProxySettings = inheritProxySettings(nil, dirs)
+	warnings = append(warnings, keyvalWarnings(dirs)...)
+	// the resolver applies to all upstreams of the context, wherever it's set
+	resolver, warns := processResolver(dirs, Resolver{})
+	warnings = append(warnings, warns...)
+	ss.resolver = resolver
 	for _, dir := range dirs {
 		var warns []caddyconfig.Warning
 		var err error
 		switch dir.Name() {
+		case "default_type", "resolver", "resolver_timeout": // looked up before the server blocks
+		case "proxy_pass_request_headers", "proxy_ignore_headers", "proxy_set_header": // inherited by the locations
+		case "keyval", "keyval_zone": // reported together before the server blocks
+		case "ssl_conf_command", "ssl_buffer_size":
+			warns = ss.openSSLNotice(dir)
+		case "post_action":
+			warns = processPostAction(dir)
+		case "slice":
+			warns = []caddyconfig.Warning{
+				{
+					File:      dir.File,
+					Line:      dir.Line,
+					Directive: dir.Name(),
+					Message:   ErrSlice,
+				},
+			}
 		case "index":
 			for k, d := range dirs {
 				if d.Name() == "server" {
@@ -118,6 +343,9 @@ func (ss *setupState) httpContext(dirs []Directive) ([]caddyconfig.Warning, erro
 				}
 			}
 		case "server":
+			if !ss.selected(dir.Block) {
+				continue
+			}
 			warns, err = ss.serverContext(dir.Block)
 		case "upstream":
 			up, w, err := ss.upstreamContext(dir.Block)
@@ -129,13 +357,24 @@ func (ss *setupState) httpContext(dirs []Directive) ([]caddyconfig.Warning, erro
 				ss.upstreams = make(map[string]Upstream)
 			}
 			ss.upstreams[dir.Param(1)] = up
+		case "map":
+			m, w := ss.mapContext(dir)
+			warns = append(warns, w...)
+			if ss.maps == nil {
+				ss.maps = make(map[string]Map)
+			}
+			ss.maps[m.Variable] = m
 		default:
+			if w, ok := ss.proxySSLNotice(dir); ok {
+				warns = w
+				break
+			}
 			warns = []caddyconfig.Warning{
 				{
 					File:      dir.File,
 					Line:      dir.Line,
 					Directive: dir.Name(),
-					Message:   ErrUnrecognized,
+					Message:   unrecognizedMessage(dir),
 				},
 			}
 		}
@@ -144,37 +383,101 @@ func (ss *setupState) httpContext(dirs []Directive) ([]caddyconfig.Warning, erro
 			return warnings, err
 		}
 	}
+	warnings = append(warnings, ss.unknownVarWarnings(dirs, warnings)...)
 	return warnings, nil
 }
 
 var nginxToCaddyVars = map[string]string{
-	"$host:$port":     "{http.request.hostport}",
-	"$hostname:$port": "{http.request.hostport}",
-	"$host":           "{http.request.host}",
-	"$hostname":       "{http.request.host}",
-	"$server_port":    "{http.request.port}",
-	"$scheme":         "{http.request.scheme}",
-	"$request_uri":    "{http.request.uri}",
-	"$query_string":   "{http.request.uri.query_string}",
-	"$args":           "{http.request.uri.query_string}",
-	"$request_method": "{http.request.method}",
+	"$host:$port":      "{http.request.hostport}",
+	"$hostname:$port":  "{http.request.hostport}",
+	"$host":            "{http.request.host}",
+	"$hostname":        "{http.request.host}",
+	"$server_port":     "{http.request.port}",
+	"$scheme":          "{http.request.scheme}",
+	"$request_uri":     "{http.request.uri}",
+	"$uri":             "{http.request.uri.path}",
+	"$document_uri":    "{http.request.uri.path}",
+	"$query_string":    "{http.request.uri.query}",
+	"$args":            "{http.request.uri.query}",
+	"$request_method":  "{http.request.method}",
+	"$server_addr":     "{http.request.local.host}",
+	"$server_protocol": "{http.request.proto}",
+	// the client address, as $binary_remote_addr in its packed form for the keys of zones and hashes
+	"$remote_addr":        clientIPPlaceholder,
+	"$binary_remote_addr": clientIPPlaceholder,
+	// the name is set for each server as there's no placeholder for it
+	"$server_name": "{http.vars.server_name}",
+	// the upstream of reverse_proxy, once it responded, see upstreamVarNotes
+	"$upstream_addr":          "{http.reverse_proxy.upstream.hostport}",
+	"$upstream_header_time":   "{http.reverse_proxy.upstream.latency_ms}",
+	"$upstream_response_time": "{http.reverse_proxy.upstream.duration_ms}",
+}
+
+// upstreamVarNotes tells how the `$upstream_*` variables differ in Caddy, if they do, by name.
+var upstreamVarNotes = map[string]string{
+	"upstream_header_time":   "the time to receive the response header from the upstream is given in milliseconds by Caddy, not seconds",
+	"upstream_response_time": "the upstream response time is given in milliseconds by Caddy, not seconds, and only once the response body is sent, so it's empty in response header fields; $upstream_header_time is available for them",
+	"upstream_status":        "Caddy has no placeholder for the status of the upstream response outside of the handle_response routes of reverse_proxy, the access logs of Caddy record the status sent to the client",
+	"upstream_cache_status":  "Caddy has no built-in cache, the cache handlers such as github.com/caddyserver/cache-handler report the cache status in the Cache-Status header field",
+}
+
+// upstreamVarWarnings returns the warnings about the `$upstream_*` variables referenced by the
+// directive which have no Caddy equivalent or a different one.
+func upstreamVarWarnings(dir Directive) []caddyconfig.Warning {
+	var warns []caddyconfig.Warning
+	for _, p := range dir.Params[1:] {
+		for _, m := range nginxVarRE.FindAllStringSubmatch(p, -1) {
+			if note, ok := upstreamVarNotes[m[1]+m[2]]; ok {
+				warns = append(warns, caddyconfig.Warning{
+					File:      dir.File,
+					Line:      dir.Line,
+					Directive: dir.Name(),
+					Message:   note,
+				})
+			}
+		}
+	}
+	return warns
 }
 
+// getCaddyVar returns the Caddy placeholder of the nginx variable. The variables with no Caddy
+// equivalent are expected to be set as variables of the request, e.g. by `set` or `map`.
 func getCaddyVar(nginxVar string) string {
-	if v, ok := nginxToCaddyVars[nginxVar]; ok {
+	if v, ok := nginxKeyPlaceholder(nginxVar); ok {
 		return v
 	}
-	if strings.HasPrefix(nginxVar, "$cookie_") {
-		return fmt.Sprintf("{http.request.cookie.%s}", strings.TrimPrefix(nginxVar, "$cookie_"))
-	}
-	// variables prefixed with `$http_` correspond to respective header field with the suffix name
-	// Source: https://nginx.org/en/docs/http/ngx_http_core_module.html#var_http_
-	if strings.HasPrefix(nginxVar, "$http_") {
-		return fmt.Sprintf("{http.request.header.%s}", strings.TrimPrefix(nginxVar, "$http_"))
-	}
 	return fmt.Sprintf("{http.vars.%s}", strings.TrimPrefix(nginxVar, "$"))
 }
 
+var nginxVarRE = regexp.MustCompile(`\$(?:\{(\w+)\}|(\w+))`)
+
+// replaceNginxVars replaces the nginx variables referenced in s with their Caddy placeholders. It's
+// the translation applied to the values of directives making up response bodies, header fields and
+// URIs, such as `https://$host:8443$request_uri?x=$arg_x`.
+func replaceNginxVars(s string) string {
+	return nginxVarRE.ReplaceAllStringFunc(s, func(v string) string {
+		return getCaddyVar("$" + strings.Trim(v[1:], "{}"))
+	})
+}
+
+// referencesVariable reports whether any of the directives, or the directives in their blocks,
+// reference the nginx variable name, without its `$`.
+func referencesVariable(dirs []Directive, name string) bool {
+	for _, dir := range dirs {
+		for _, p := range dir.Params {
+			for _, m := range nginxVarRE.FindAllStringSubmatch(p, -1) {
+				if m[1] == name || m[2] == name {
+					return true
+				}
+			}
+		}
+		if referencesVariable(dir.Block, name) {
+			return true
+		}
+	}
+	return false
+}
+
 func encodeMatcherSets(currentMatcherSet []map[string]caddyhttp.RequestMatcher) (caddyhttp.RawMatcherSets, error) {
 	// encode the matchers then set the result as raw matcher config
 	var matcherSetsEnc caddyhttp.RawMatcherSets
@@ -192,6 +495,306 @@ func encodeMatcherSets(currentMatcherSet []map[string]caddyhttp.RequestMatcher)
 	return matcherSetsEnc, nil
 }
 
+// njsPhases maps the njs directives running scripts to the processing they take part in.
+var njsPhases = map[string]string{
+	"js_header_filter": "response header filter phase",
+	"js_body_filter":   "response body filter phase",
+	"js_content":       "content phase generating the response",
+	"js_access":        "access phase checking the request",
+	"js_set":           "variable evaluation of the request",
+	"js_periodic":      "periodic tasks",
+}
+
+// unrecognizedMessage returns the message of the warning for dir not being converted, which
+// names the phase of njs directives so it's clear what request or response handling is lost.
+func unrecognizedMessage(dir Directive) string {
+	if phase, ok := njsPhases[dir.Name()]; ok {
+		return fmt.Sprintf("%s: njs is not supported, so the script in the %s is lost", ErrUnrecognized, phase)
+	}
+	return ErrUnrecognized
+}
+
+// keyvalWarnings returns a single warning for the `keyval` directives of NGINX Plus among dirs,
+// listing the variables they set. Caddy has no key-value store updated at runtime, so these
+// variables are undefined after adaptation.
+func keyvalWarnings(dirs []Directive) []caddyconfig.Warning {
+	keyvals := getAllDirectives(dirs, "keyval")
+	if len(keyvals) == 0 {
+		return nil
+	}
+	var vars []string
+	for _, dir := range keyvals {
+		vars = append(vars, dir.Param(2))
+	}
+	return []caddyconfig.Warning{
+		{
+			File:      keyvals[0].File,
+			Line:      keyvals[0].Line,
+			Directive: keyvals[0].Name(),
+			Message: fmt.Sprintf("Caddy has no runtime key-value store like keyval_zone; these variables are undefined after adaptation: %s",
+				strings.Join(vars, ", ")),
+		},
+	}
+}
+
+// convertedVars are the nginx variables without a Caddy placeholder which the directives
+// referencing them convert by themselves, e.g. `$is_args$args` or `proxy_set_header Host $proxy_host`.
+var convertedVars = map[string]bool{
+	"is_args":                   true,
+	"proxy_host":                true,
+	"proxy_add_x_forwarded_for": true,
+	"slice_range":               true,
+}
+
+var namedCaptureRE = regexp.MustCompile(`\(\?P?<(\w+)>`)
+
+// unknownVarWarnings returns the warnings about the variables referenced by the directives dirs of
+// the http context which are neither known to Caddy nor set by the config, e.g. by `set`, `map` or
+// the named captures of the regexps. Such variables become request variables that nothing sets,
+// so they are empty. The directives reported as not converted among warnings are left out, as
+// well as the server blocks that aren't selected.
+func (ss *setupState) unknownVarWarnings(dirs []Directive, warnings []caddyconfig.Warning) []caddyconfig.Warning {
+	unsupported := make(map[caddyconfig.Warning]bool)
+	for _, w := range warnings {
+		if strings.HasPrefix(w.Message, ErrUnrecognized) {
+			unsupported[caddyconfig.Warning{File: w.File, Line: w.Line, Directive: w.Directive}] = true
+		}
+	}
+	defined := make(map[string]bool)
+	var define func(dirs []Directive)
+	define = func(dirs []Directive) {
+		for _, dir := range dirs {
+			switch dir.Name() {
+			case "set":
+				defined[strings.TrimPrefix(dir.Param(1), "$")] = true
+			case "map", "keyval":
+				// the variables of keyval are reported by keyvalWarnings
+				defined[strings.TrimPrefix(dir.Param(2), "$")] = true
+			}
+			for _, p := range dir.Params[1:] {
+				for _, m := range namedCaptureRE.FindAllStringSubmatch(p, -1) {
+					defined[m[1]] = true
+				}
+			}
+			if dir.Name() != "map" {
+				define(dir.Block)
+			}
+		}
+	}
+	define(dirs)
+	known := func(name string) bool {
+		if _, ok := nginxKeyPlaceholder("$" + name); ok {
+			return true
+		}
+		if _, ok := upstreamVarNotes[name]; ok {
+			return true // reported by upstreamVarWarnings
+		}
+		_, err := strconv.Atoi(name) // the numbered captures of the regexps
+		return err == nil || defined[name] || convertedVars[name] || strings.HasPrefix(name, "sent_http_")
+	}
+
+	var warns []caddyconfig.Warning
+	report := func(dir Directive, params []string) {
+		seen := make(map[string]bool)
+		for _, p := range params {
+			for _, m := range nginxVarRE.FindAllStringSubmatch(p, -1) {
+				name := m[1] + m[2]
+				if known(name) || seen[name] {
+					continue
+				}
+				seen[name] = true
+				warns = append(warns, caddyconfig.Warning{
+					File:      dir.File,
+					Line:      dir.Line,
+					Directive: dir.Name(),
+					Message:   fmt.Sprintf("$%s has no Caddy equivalent and isn't set by set or map; it becomes the empty request variable {http.vars.%s}", name, name),
+				})
+			}
+		}
+	}
+	var walk func(dirs []Directive)
+	walk = func(dirs []Directive) {
+		for _, dir := range dirs {
+			if unsupported[caddyconfig.Warning{File: dir.File, Line: dir.Line, Directive: dir.Name()}] {
+				continue
+			}
+			switch dir.Name() {
+			case "server":
+				if !ss.selected(dir.Block) {
+					continue
+				}
+			case "set":
+				report(dir, dir.Params[2:])
+				continue
+			case "map":
+				// the source, and the values of the entries
+				report(dir, dir.Params[1:2])
+				for _, entry := range dir.Block {
+					report(entry, entry.Params[1:])
+				}
+				continue
+			}
+			report(dir, dir.Params[1:])
+			walk(dir.Block)
+		}
+	}
+	walk(dirs)
+	return warns
+}
+
+// selected reports whether the server block with the given directives is to be adapted, which is
+// when one of its names matches one of the patterns of the "only_hosts" option, if given. The
+// patterns match as in path.Match, e.g. `*.api.example.com`.
+func (ss *setupState) selected(dirs []Directive) bool {
+	if len(ss.onlyHosts) == 0 {
+		return true
+	}
+	for _, name := range serverNames(getAllDirectives(dirs, "server_name")) {
+		for _, pattern := range ss.onlyHosts {
+			if ok, _ := path.Match(pattern, name); ok || strings.EqualFold(pattern, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// workerNotes tells what becomes of the directives tuning the capacity of nginx, which users
+// migrating wonder about, as Caddy serves the connections with goroutines spread over all the
+// CPU cores of a single process.
+var workerNotes = map[string]string{
+	"worker_processes":     "Caddy runs as a single process using all CPU cores, scheduled by Go (see GOMAXPROCS); no setting is needed",
+	"worker_rlimit_nofile": "set the open files limit of the Caddy process instead, e.g. with LimitNOFILE= in its systemd unit",
+	"multi_accept":         "Go's network poller accepts the connections as they come; no setting is needed",
+	"use":                  "Go's network poller picks the connection processing method of the platform; no setting is needed",
+	"accept_mutex":         "Caddy accepts the connections in a single process; no setting is needed",
+}
+
+// processEvents processes the `events` block, whose directives tune the connection processing.
+// Caddy has no connection limit, so `worker_connections` is translated into the open files
+// limit the Caddy process needs for the same capacity.
+func processEvents(dir Directive, workers Directive) []caddyconfig.Warning {
+	var warns []caddyconfig.Warning
+	for _, d := range dir.Block {
+		var msg string
+		switch d.Name() {
+		case "worker_connections":
+			connections, err := strconv.Atoi(d.Param(1))
+			if err != nil {
+				msg = fmt.Sprintf("invalid number of connections: %s", d.Param(1))
+				break
+			}
+			msg = fmt.Sprintf("Caddy has no connection limit; for the same capacity, the open files limit of the Caddy process should be at least %d", connections)
+			if n, err := strconv.Atoi(workers.Param(1)); err == nil && n > 1 {
+				msg = fmt.Sprintf("Caddy has no connection limit; for the same capacity, the open files limit of the Caddy process should be at least %d (%d connections for each of %d workers)",
+					connections*n, connections, n)
+			}
+		default:
+			var ok bool
+			if msg, ok = workerNotes[d.Name()]; !ok {
+				msg = ErrUnrecognized
+			}
+		}
+		warns = append(warns, caddyconfig.Warning{
+			File:      d.File,
+			Line:      d.Line,
+			Directive: d.Name(),
+			Message:   msg,
+		})
+	}
+	return warns
+}
+
+// openSSLNotice returns the notice that dir is specific to OpenSSL, such as `ssl_engine` or
+// `ssl_conf_command`, on its first occurrence only, so hardened configs repeating these
+// directives in every server block don't drown in warnings.
+func (ss *setupState) openSSLNotice(dir Directive) []caddyconfig.Warning {
+	if ss.openSSLNoticed[dir.Name()] {
+		return nil
+	}
+	if ss.openSSLNoticed == nil {
+		ss.openSSLNoticed = make(map[string]bool)
+	}
+	ss.openSSLNoticed[dir.Name()] = true
+	return []caddyconfig.Warning{
+		{
+			File:      dir.File,
+			Line:      dir.Line,
+			Directive: dir.Name(),
+			Message:   ErrOpenSSL,
+		},
+	}
+}
+
+// summary returns the warnings summarizing the adaptation of dirs: how many of the directives
+// were converted given the warnings of the adaptation, and which modules not part of the
+// standard Caddy distribution the resulting config requires.
+func (ss *setupState) summary(dirs []Directive, warnings []caddyconfig.Warning) []caddyconfig.Warning {
+	unsupported := make(map[string]bool)
+	for _, w := range warnings {
+		if strings.HasPrefix(w.Message, ErrUnrecognized) {
+			unsupported[fmt.Sprintf("%s:%d:%s", w.File, w.Line, w.Directive)] = true
+		}
+	}
+	total := countDirectives(dirs)
+	converted := total - len(unsupported)
+	coverage := 100.0
+	if total > 0 {
+		coverage = float64(converted) * 100 / float64(total)
+	}
+	summary := []caddyconfig.Warning{
+		{Message: fmt.Sprintf("coverage: %d of %d directives converted (%.1f%%)", converted, total, coverage)},
+	}
+	// the servers needing a review come first, as the ones to test first
+	servers := serverConfidences(dirs, warnings)
+	sort.SliceStable(servers, func(i, j int) bool {
+		return confidenceOrder[servers[i].Confidence] < confidenceOrder[servers[j].Confidence]
+	})
+	for _, sc := range servers {
+		msg := fmt.Sprintf("server %s: %s confidence, %d of %d directives converted", sc.Name, sc.Confidence, sc.Converted, sc.Total)
+		if sc.Caveats > 0 {
+			msg += fmt.Sprintf(", %d with caveats", sc.Caveats)
+		}
+		summary = append(summary, caddyconfig.Warning{File: sc.File, Line: sc.Line, Directive: "server", Message: msg})
+	}
+
+	var plugins []string
+	for _, u := range ss.upstreams {
+		if u.NTLM {
+			plugins = append(plugins, "github.com/caddyserver/ntlm-transport")
+			break
+		}
+	}
+	if ss.layer4 != nil {
+		plugins = append(plugins, layer4Plugin)
+	}
+	if len(plugins) > 0 {
+		summary = append(summary, caddyconfig.Warning{
+			Message: "required plugins: " + strings.Join(plugins, ", "),
+		})
+	}
+	return summary
+}
+
+// confidenceOrder sorts the confidence ratings from the least confident.
+var confidenceOrder = map[string]int{
+	ConfidenceManualReview: 0,
+	ConfidencePartial:      1,
+	ConfidenceFull:         2,
+}
+
+// countDirectives returns the number of directives in dirs, including those in their blocks. The
+// lines of the `map` blocks are entries of the map, not directives.
+func countDirectives(dirs []Directive) int {
+	n := len(dirs)
+	for _, dir := range dirs {
+		if dir.Name() != "map" {
+			n += countDirectives(dir.Block)
+		}
+	}
+	return n
+}
+
 func isNumeric(s string) bool {
 	_, err := strconv.Atoi(s)
 	return err == nil
@@ -0,0 +1,285 @@
+package nginxconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// adaptTest is a config to adapt along with what's expected of the generated Caddy JSON.
+type adaptTest struct {
+	name string
+	conf string
+	// the app whose servers the paths of want start from, http if empty
+	app string
+	// the values expected in the servers of the app, as JSON, by their path, see lookup; an
+	// empty value expects nothing at the path
+	want map[string]string
+	// the messages expected among the adaptation warnings
+	warnings []string
+}
+
+func runAdaptTests(t *testing.T, tests []adaptTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, warnings := adapt(t, []byte(tt.conf), nil)
+			app := tt.app
+			if app == "" {
+				app = "http"
+			}
+			servers, _ := lookup(cfg, "apps."+app+".servers")
+			checkServers(t, servers, tt.want)
+			for _, msg := range tt.warnings {
+				if !slices.Contains(warnings, msg) {
+					t.Errorf("missing warning %q, got %q", msg, warnings)
+				}
+			}
+		})
+	}
+}
+
+// adapt adapts the nginx config in body with the given options, normalized, and returns the config
+// as decoded from the JSON along with the messages of the warnings.
+func adapt(t *testing.T, body []byte, options map[string]interface{}) (interface{}, []string) {
+	t.Helper()
+	opts := map[string]interface{}{"normalize": true}
+	for k, v := range options {
+		opts[k] = v
+	}
+	result, warnings, err := Adapter{}.Adapt(body, opts)
+	if err != nil {
+		t.Fatalf("adapting: %v", err)
+	}
+	var cfg interface{}
+	if err := json.Unmarshal(result, &cfg); err != nil {
+		t.Fatalf("decoding the adapted config: %v", err)
+	}
+	var messages []string
+	for _, w := range warnings {
+		messages = append(messages, w.Message)
+	}
+	return cfg, messages
+}
+
+// checkServers checks the values of the decoded servers at the paths of want.
+func checkServers(t *testing.T, servers interface{}, want map[string]string) {
+	t.Helper()
+	for path, expected := range want {
+		v, found := lookup(servers, path)
+		switch {
+		case !found && expected != "":
+			t.Errorf("%s: nothing found, want %s", path, expected)
+		case found && expected == "":
+			t.Errorf("%s: got %s, want nothing", path, encode(t, v))
+		case found && encode(t, v) != expected:
+			t.Errorf("%s: got %s, want %s", path, encode(t, v), expected)
+		}
+	}
+}
+
+// lookup returns the value at the dot-separated path in the decoded JSON v, where the numbers
+// index the arrays, and whether there's one.
+func lookup(v interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = node[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// encode returns the JSON of the decoded value v, with the keys sorted and the HTML characters of
+// the regexps left as they are.
+func encode(t *testing.T, v interface{}) string {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		t.Fatalf("encoding: %v", err)
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// TestAdaptTestdata adapts the configs of testdata, except for the files they include, and checks
+// the generated servers.
+func TestAdaptTestdata(t *testing.T) {
+	want := map[string]map[string]string{
+		// the server blocks listening on the same port make up a single Caddy server, the routes
+		// of each block matching its names, and the included block comes first
+		"example1.conf": {
+			"server_0.routes.0.match":    `[{"host":["domain3.com","www.domain3.com"],"path_regexp":{"name":"location","pattern":"\\.php$"}}]`,
+			"server_0.routes.1.match":    `[{"host":["domain3.com","www.domain3.com"]}]`,
+			"server_0.routes.2.match":    `[{"host":["domain1.com","www.domain1.com"],"path_regexp":{"name":"location","pattern":"\\.php$"}}]`,
+			"server_0.routes.3.handle.0": `{"handler":"file_server","index_names":["index.html","index.htm","index.php"],"root":"html"}`,
+			"server_0.routes.4.match":    `[{"host":["domain2.com","www.domain2.com"],"path_regexp":{"name":"location","pattern":"^/(images|javascript|js|css|flash|media|static)/"}}]`,
+			"server_0.routes.5.match":    `[{"host":["domain2.com","www.domain2.com"],"path":["/*"]}]`,
+			"server_0.routes.6.match":    `[{"host":["big.server.com"],"path":["/*"]}]`,
+			"server_0.routes.7":          "",
+			"server_1":                   "",
+		},
+		// the access rules run ahead of the content of their location, the socket peers not
+		// matching any client address, and the denied requests get the forbidden page of their
+		// location or else the one of the server
+		"access.conf": {
+			"server_0.routes.0.match":                                      `[{"host":["appliance.local"],"path":["/status*"]}]`,
+			"server_0.routes.0.handle.0.routes.0.handle.0.routes.0":        `{"match":[{"remote_ip":{"ranges":["10.0.0.0/8"]}}],"terminal":true}`,
+			"server_0.routes.0.handle.0.routes.0.handle.0.routes.1":        `{"match":[{"remote_ip":{"ranges":["fd00::/8"]}}],"terminal":true}`,
+			"server_0.routes.0.handle.0.routes.0.handle.0.routes.2":        `{"match":[{"not":[{"remote_ip":{"ranges":["0.0.0.0/0","::/0"]}}]}],"terminal":true}`,
+			"server_0.routes.0.handle.0.routes.0.handle.0.routes.3":        `{"handle":[{"handler":"static_response","status_code":403}],"match":[{"remote_ip":{"ranges":["0.0.0.0/0","::/0"]}},{"not":[{"remote_ip":{"ranges":["0.0.0.0/0","::/0"]}}]}],"terminal":true}`,
+			"server_0.routes.0.handle.0.routes.0.handle.1.handler":         `"reverse_proxy"`,
+			"server_0.routes.2.match":                                      `[{"host":["appliance.local"],"path":["/*"]}]`,
+			"server_0.routes.2.handle.0.routes.0.handle.0.routes.1":        `{"handle":[{"handler":"static_response","status_code":403}],"match":[{"remote_ip":{"ranges":["192.168.1.13/32"]}}],"terminal":true}`,
+			"server_0.routes.2.handle.0.routes.0.handle.0.routes.2":        "",
+			"server_0.routes.2.handle.0.routes.0.handle.1.handler":         `"file_server"`,
+			"server_0.routes.3.match":                                      `[{"host":["intranet.local"],"path":["/finance/*"]}]`,
+			"server_0.routes.3.handle.0.routes.0.handle.0.routes.1.handle": `[{"handler":"rewrite","uri":"/errors/finance.html"},{"handler":"file_server","root":"/srv/intranet","status_code":403}]`,
+			"server_0.routes.4.match":                                      `[{"host":["intranet.local"],"path":["/hr/*"]}]`,
+			"server_0.routes.4.handle.0.routes.0.handle.0.routes.1.handle": `[{"handler":"error","status_code":403}]`,
+			"server_0.routes.5.handle.0":                                   `{"handler":"file_server","root":"/srv/intranet"}`,
+		},
+		// the front controllers are converted in place of the fallback of try_files, as Caddy
+		// doesn't select the locations again once the URI is rewritten
+		"frontcontroller.conf": {
+			"server_0.routes.0.match": `[{"host":["laravel.example.com"],"path_regexp":{"name":"location","pattern":"\\.php$"}}]`,
+			"server_0.routes.1.match": `[{"host":["laravel.example.com"],"path":["/*"]}]`,
+			"server_0.routes.1.handle.0.routes.0.handle.0.routes.1.handle.0.uri":            `"/index.php?{http.request.uri.query}"`,
+			"server_0.routes.1.handle.0.routes.0.handle.0.routes.1.handle.1.routes.0.match": `[{"path_regexp":{"name":"location","pattern":"\\.php$"}}]`,
+			"server_0.routes.2.match":    `[{"host":["laravel.example.com"]}]`,
+			"server_0.routes.2.handle.0": `{"handler":"file_server","root":"/srv/laravel/public"}`,
+			"server_0.routes.4.handle.0.routes.0.handle.0.routes.1.handle.0.uri":            `"/index.php?{http.request.uri.query}"`,
+			"server_0.routes.4.handle.0.routes.0.handle.0.routes.1.handle.1.routes.0.match": `[{"path_regexp":{"name":"location","pattern":"^/index\\.php(/|$)"}}]`,
+			"server_0.routes.6.handle.0.routes.0.handle.0.routes.1.handle.0.uri":            `"/router.php?"`,
+			"server_0.routes.6.handle.0.routes.0.handle.0.routes.1.handle.1":                "",
+		},
+		// the cookies and query arguments compared in `if` conditions, empty when missing as in
+		// nginx
+		"login.conf": {
+			"server_0.routes.0.match":                                     `[{"host":["app.example.com"],"path":["/account/*"]}]`,
+			"server_0.routes.0.handle.0.routes.0.handle.0.routes.0.match": `[{"vars":{"{http.request.cookie.session}":[""]}}]`,
+			"server_0.routes.1.match":                                     `[{"host":["app.example.com"],"path":["/admin/*"]}]`,
+			"server_0.routes.1.handle.0.routes.0.handle.0.routes.0.match": `[{"not":[{"vars_regexp":{"{http.request.cookie.role}":{"pattern":"(?i)^(admin|owner)$"}}}]}]`,
+			"server_0.routes.2.match":                                     `[{"host":["app.example.com"],"path":["/login*"]}]`,
+			"server_0.routes.2.handle.0.routes.0.handle.0.routes.0.match": `[{"query":{"state":["done"]}}]`,
+			"server_0.routes.2.handle.0.routes.0.handle.1.routes.0.match": `[{"not":[{"vars":{"{http.request.uri.query.next}":["","0"]}}]}]`,
+		},
+		// the header fields set from the upstream of reverse_proxy
+		"proxyheaders.conf": {
+			"server_0.routes.0.match":                              `[{"host":["app.example.com"],"path":["/*"]}]`,
+			"server_0.routes.0.handle.0.routes.0.handle.0.handler": `"reverse_proxy"`,
+			"server_0.routes.0.handle.0.routes.0.handle.1":         `{"handler":"headers","response":{"deferred":true,"set":{"X-Upstream":["{http.reverse_proxy.upstream.hostport}"]}}}`,
+			"server_0.routes.0.handle.0.routes.0.handle.2":         `{"handler":"headers","response":{"deferred":true,"set":{"X-Upstream-Header-Time":["{http.reverse_proxy.upstream.latency_ms}"]}}}`,
+		},
+	}
+	for name, paths := range want {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join("testdata", name)
+			body, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, _ := adapt(t, body, map[string]interface{}{"filename": file})
+			servers, _ := lookup(cfg, "apps.http.servers")
+			checkServers(t, servers, paths)
+		})
+	}
+}
+
+func TestEnvOptions(t *testing.T) {
+	conf := []byte(`http {
+		server {
+			listen 80;
+			server_name example.com;
+			return 200 ok;
+		}
+	}`)
+	tests := []struct {
+		name    string
+		env     map[string]string
+		options map[string]interface{}
+		// whether the output is expected to be indented, as normalized configs are by default
+		indented    bool
+		stamped     bool
+		unsupported bool
+		// whether the output is expected to have no server, none being selected
+		empty bool
+	}{
+		{
+			name:     "normalized",
+			env:      map[string]string{"NGINX_ADAPTER_NORMALIZE": "true"},
+			indented: true,
+		},
+		{
+			name: "normalized and minified",
+			env:  map[string]string{"NGINX_ADAPTER_NORMALIZE": "1", "NGINX_ADAPTER_MINIFY": "1"},
+		},
+		{
+			name:    "stamped",
+			env:     map[string]string{"NGINX_ADAPTER_STAMP": "true"},
+			stamped: true,
+		},
+		{
+			name:        "unsupported directives recorded",
+			env:         map[string]string{"NGINX_ADAPTER_UNSUPPORTED_METADATA": "true"},
+			unsupported: true,
+		},
+		{
+			name:  "selected server blocks",
+			env:   map[string]string{"NGINX_ADAPTER_ONLY_HOSTS": "other.example.com"},
+			empty: true,
+		},
+		{
+			name:    "option given over the environment",
+			env:     map[string]string{"NGINX_ADAPTER_NORMALIZE": "true"},
+			options: map[string]interface{}{"normalize": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			result, _, err := Adapter{}.Adapt(conf, tt.options)
+			if err != nil {
+				t.Fatalf("adapting: %v", err)
+			}
+			if indented := bytes.Contains(result, []byte("\n")); indented != tt.indented {
+				t.Errorf("indented: got %t, want %t", indented, tt.indented)
+			}
+			if stamped := bytes.Contains(result, []byte(`"@id":"nginx-adapter:`)); stamped != tt.stamped {
+				t.Errorf("stamped: got %t, want %t", stamped, tt.stamped)
+			}
+			if unsupported := bytes.Contains(result, []byte(`"_nginx_unsupported":`)); unsupported != tt.unsupported {
+				t.Errorf("unsupported directives recorded: got %t, want %t", unsupported, tt.unsupported)
+			}
+			if empty := !bytes.Contains(result, []byte("example.com")); empty != tt.empty {
+				t.Errorf("no server: got %t, want %t", empty, tt.empty)
+			}
+		})
+	}
+
+	t.Run("invalid value", func(t *testing.T) {
+		t.Setenv("NGINX_ADAPTER_NORMALIZE", "maybe")
+		if _, _, err := (Adapter{}).Adapt(conf, nil); err == nil {
+			t.Error("adapting: got no error")
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package nginxconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// normalizeJSON re-encodes the Caddy JSON in b with the null and empty-array fields left out and the
+// keys of every object sorted, so the configs produced by different versions of the adapter only
+// differ where their contents do, e.g. when stored in Git. The result is indented with tabs unless
+// minify is set.
+//
+// Empty objects and strings are kept, as they are meaningful in Caddy configs, e.g. the `{}` of a
+// module using its defaults or a variable set to the empty string.
+func normalizeJSON(b []byte, minify bool) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber() // the numbers are written back as they are, such as large durations
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("normalizing: %v", err)
+	}
+	v = pruneEmpty(v)
+	if minify {
+		return json.Marshal(v)
+	}
+	return json.MarshalIndent(v, "", "\t")
+}
+
+// pruneEmpty removes the object fields which are null or empty arrays from the decoded JSON value
+// v, recursively. The elements of arrays are left as they are, since their position matters.
+func pruneEmpty(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			field = pruneEmpty(field)
+			if a, ok := field.([]interface{}); field == nil || (ok && len(a) == 0) {
+				delete(v, k)
+				continue
+			}
+			v[k] = field
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = pruneEmpty(elem)
+		}
+	}
+	return v
+}
+
+// normalizeOptions returns whether the adaptation options ask for the output to be normalized, and
+// minified as well.
+func normalizeOptions(options map[string]interface{}) (normalize, minify bool) {
+	normalize, _ = options["normalize"].(bool)
+	minify, _ = options["minify"].(bool)
+	return normalize, minify
+}
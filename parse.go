@@ -15,6 +15,8 @@
 package nginxconf
 
 import (
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -23,55 +25,94 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	which "github.com/hairyhenderson/go-which"
 )
 
-// Reference: https://wiki.debian.org/Nginx/DirectoryStructure
-var nginxConfPrefix string
+// confLayout is the layout of the nginx installation that included files are looked up in. It
+// is set up for each adaptation, so concurrent adaptations don't share any mutable state.
+type confLayout struct {
+	// prefix is the directory of the installation, holding the standard snippets
+	prefix string
+	// dirs are the subdirectories of prefix searched for the included files
+	dirs []string
+	// base is the directory that relative includes without globs are resolved against, if given
+	base string
+}
 
-func init() {
+// defaultConfLayout returns the layout of the nginx installation of the current platform.
+// Reference: https://wiki.debian.org/Nginx/DirectoryStructure
+func defaultConfLayout() confLayout {
+	layout := confLayout{
+		dirs: []string{
+			"conf.d/",
+			"modules-available/",
+			"modules-enabled/",
+			"sites-available/",
+			"sites-enabled/",
+			"snippets/",
+		},
+	}
+	confDirInstead := func() {
+		for k, v := range layout.dirs {
+			if v == "conf.d/" {
+				layout.dirs[k] = "conf/"
+			}
+		}
+	}
 	switch runtime.GOOS {
 	case "freebsd", "darwin":
 		// https://www.cyberciti.biz/faq/freebsd-install-nginx-webserver/
-		nginxConfPrefix = "/usr/local/etc/nginx"
+		layout.prefix = "/usr/local/etc/nginx"
 	case "netbsd":
 		// https://www.netbsd.mx/nginx-php.html
-		nginxConfPrefix = "/usr/pkg/etc/nginx"
+		layout.prefix = "/usr/pkg/etc/nginx"
 	case "solaris", "illumos":
 		// https://www.nginx.com/resources/wiki/start/topics/tutorials/solaris_11/
-		nginxConfPrefix = "/opt/local/nginx"
-		for k, v := range nginxConfDirs {
-			if v == "conf.d/" {
-				nginxConfDirs[k] = "conf/"
-			}
-		}
+		layout.prefix = "/opt/local/nginx"
+		confDirInstead()
 	case "windows":
 		// "nginx/Windows uses the directory where it has been run as the prefix for relative paths in the configuration."
 		// Source: https://nginx.org/en/docs/windows.html
 		// However, the "conf/" directory, where some of the standard snippets live, is neighboring the nginx.exe. Therefore,
 		// it's more likely to hit a match in this root than elsewhere.
 		nginxPath := which.Which("nginx.exe")
-		nginxConfPrefix = filepath.Dir(nginxPath)
-		for k, v := range nginxConfDirs {
-			if v == "conf.d/" {
-				nginxConfDirs[k] = "conf/"
-			}
-		}
+		layout.prefix = filepath.Dir(nginxPath)
+		confDirInstead()
 	default:
-		nginxConfPrefix = "/etc/nginx"
+		layout.prefix = "/etc/nginx"
 	}
-}
-
-func parse(tokens []token) ([]Directive, error) {
-	parser := nginxParser{tokens: tokens}
-	return parser.nextBlock()
+	return layout
 }
 
 type nginxParser struct {
 	tokens []token
 	cursor int // incrementing this is analogous to consuming the token
+	layout confLayout
+
+	// graph records the included files if not nil, including the includes matching no file
+	graph *IncludeGraph
+
+	// warnings reports the includes matching no file, which are skipped as nothing would be
+	// gained from failing the whole adaptation
+	warnings []caddyconfig.Warning
+
+	// included caches the files already included by path, as snippets like fastcgi_params are
+	// included by many server blocks of multi-site configs
+	included map[string]lexedFile
 }
 
+// lexedFile is the tokens of a file along with its number of lines and the checksum of its
+// contents.
+type lexedFile struct {
+	tokens []token
+	lines  int
+	sum    [sha256.Size]byte
+}
+
+// errNoDirective is returned by next when only includes contributing no tokens were consumed.
+var errNoDirective = errors.New("no directive")
+
 func (p *nginxParser) currentToken() token {
 	return p.tokens[p.cursor]
 }
@@ -94,6 +135,9 @@ func (p *nginxParser) nextBlock() ([]Directive, error) {
 		if err == io.EOF {
 			break
 		}
+		if err == errNoDirective {
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -133,6 +177,10 @@ func (p *nginxParser) next() (Directive, error) {
 			if err != nil {
 				return Directive{}, err
 			}
+			if len(dir.Params) == 0 && (p.cursor >= len(p.tokens) || p.tokens[p.cursor].text == "}") {
+				// the include was the last directive of the block
+				return Directive{}, errNoDirective
+			}
 			tkn = p.tokens[p.cursor]
 			dir.File = tkn.file
 			dir.Line = tkn.line
@@ -142,14 +190,6 @@ func (p *nginxParser) next() (Directive, error) {
 	return dir, nil
 }
 
-var nginxConfDirs = []string{
-	"conf.d/",
-	"modules-available/",
-	"modules-enabled/",
-	"sites-available/",
-	"sites-enabled/",
-	"snippets/",
-}
 var nginxStdConfs = []string{
 	"fastcgi.conf",
 	"fastcgi_params",
@@ -163,10 +203,9 @@ var nginxStdConfs = []string{
 	"win-utf",
 }
 
-// TODO: support relative path includes
 func (p *nginxParser) doInclude() error {
 	includeToken := p.currentToken()
-	includeArg := filepath.Clean(includeToken.text)
+	includeArg := normalizeIncludePath(includeToken.text, includeToken.file)
 
 	if strings.Count(includeArg, "*") > 1 || strings.Count(includeArg, "?") > 1 ||
 		(strings.Contains(includeArg, "[") && strings.Contains(includeArg, "]")) {
@@ -174,6 +213,9 @@ func (p *nginxParser) doInclude() error {
 		return fmt.Errorf("Glob pattern may only contain one wildcard (*), but has others: %s", includeArg)
 	}
 
+	// the paths looked up, reported if none of them exists
+	var tried []string
+
 	// first assume the included file is relative
 	var importedFiles []string
 	globArg := includeArg
@@ -181,6 +223,7 @@ func (p *nginxParser) doInclude() error {
 		currentConfDir := filepath.Dir(p.currentToken().file)
 		globArg = filepath.Join(currentConfDir, includeArg)
 	}
+	tried = append(tried, globArg)
 	matches, err := filepath.Glob(globArg)
 	if err != nil {
 		return err
@@ -191,12 +234,25 @@ func (p *nginxParser) doInclude() error {
 		}
 	}
 
+	// a single file given as a relative path may be relative to the base directory given
+	if len(importedFiles) == 0 && p.layout.base != "" && !filepath.IsAbs(includeArg) && !strings.ContainsAny(includeArg, "*?[") {
+		basePath := filepath.Join(p.layout.base, includeArg)
+		tried = append(tried, basePath)
+		if _, err := os.Stat(basePath); err == nil {
+			importedFiles = append(importedFiles, basePath)
+		}
+	}
+
 	// if not absolute, we'll only support including files within standard config location.
 	if len(importedFiles) == 0 {
 		// is it one of the standard files?
 		for _, v := range nginxStdConfs {
 			if v == includeArg {
-				importedFiles = append(importedFiles, filepath.Join(nginxConfPrefix, v))
+				stdPath := stdConfPath(p.layout.prefix, v)
+				tried = append(tried, stdPath)
+				if _, err := os.Stat(stdPath); err == nil {
+					importedFiles = append(importedFiles, stdPath)
+				}
 				break
 			}
 		}
@@ -207,8 +263,9 @@ func (p *nginxParser) doInclude() error {
 		//
 		// The `filepath.HasPrefix` is bad before it just does `strings.HasPrefix` and
 		// doesn't respoect directories boundaries.
-		for _, v := range nginxConfDirs {
-			testablePath := filepath.Join(nginxConfPrefix, v, includeArg)
+		for _, v := range p.layout.dirs {
+			testablePath := filepath.Join(p.layout.prefix, v, includeArg)
+			tried = append(tried, testablePath)
 			// The argument could have a glob (e.g. custom-*.conf), so expand the glob.
 			matches, err := filepath.Glob(filepath.Clean(testablePath))
 			if err != nil {
@@ -218,16 +275,33 @@ func (p *nginxParser) doInclude() error {
 		}
 	}
 
+	importedFiles = resolveIncludes(importedFiles)
 	if len(importedFiles) == 0 {
-		return fmt.Errorf("included file is not found: %s:%d %s", includeToken.file, includeToken.line, includeArg)
+		p.warnings = append(p.warnings, caddyconfig.Warning{
+			File:      includeToken.file,
+			Line:      includeToken.line,
+			Directive: "include",
+			Message:   fmt.Sprintf("included file is not found, the include is skipped: %s (tried %s)", includeArg, strings.Join(tried, ", ")),
+		})
+		if p.graph != nil {
+			p.graph.Unresolved = append(p.graph.Unresolved, UnresolvedInclude{
+				Pattern: includeToken.text,
+				File:    includeToken.file,
+				Line:    includeToken.line,
+				Tried:   tried,
+			})
+		}
 	}
 
 	var importedTokens []token
 	for _, importFile := range importedFiles {
-		newTokens, err := p.doSingleInclude(importFile)
+		newTokens, lines, err := p.doSingleInclude(importFile)
 		if err != nil {
 			return err
 		}
+		if p.graph != nil {
+			p.graph.add(includeToken, includeToken.text, importFile, lines)
+		}
 		importedTokens = append(importedTokens, newTokens...)
 	}
 
@@ -242,27 +316,58 @@ func (p *nginxParser) doInclude() error {
 	return nil
 }
 
+// resolveIncludes follows the symbolic links among files, as found in the Debian layout where
+// sites-enabled/ links to sites-available/, and drops the files resolving to one listed earlier
+// or to nothing at all. The remaining files keep the path they were matched by.
+func resolveIncludes(files []string) []string {
+	var resolved []string
+	seen := make(map[string]bool)
+	for _, f := range files {
+		target, err := filepath.EvalSymlinks(f)
+		if err != nil {
+			continue // dangling link or vanished file
+		}
+		if abs, err := filepath.Abs(target); err == nil {
+			target = abs
+		}
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		resolved = append(resolved, f)
+	}
+	return resolved
+}
+
 // doSingleImport lexes the individual file at importFile and returns
-// its tokens or an error, if any.
-func (p *nginxParser) doSingleInclude(importFile string) ([]token, error) {
+// its tokens and number of lines or an error, if any. Each file is only
+// read and lexed once.
+func (p *nginxParser) doSingleInclude(importFile string) ([]token, int, error) {
+	if f, ok := p.included[importFile]; ok {
+		return f.tokens, f.lines, nil
+	}
 	file, err := os.Open(importFile)
 	if err != nil {
-		return nil, fmt.Errorf("Could not import %s: %v", importFile, err)
+		return nil, 0, fmt.Errorf("Could not import %s: %v", importFile, err)
 	}
 	defer file.Close()
 
 	if info, err := file.Stat(); err != nil {
-		return nil, fmt.Errorf("Could not import %s: %v", importFile, err)
+		return nil, 0, fmt.Errorf("Could not import %s: %v", importFile, err)
 	} else if info.IsDir() {
-		return nil, fmt.Errorf("Could not import %s: is a directory", importFile)
+		return nil, 0, fmt.Errorf("Could not import %s: is a directory", importFile)
 	}
 
 	input, err := ioutil.ReadAll(file)
 	if err != nil {
-		return nil, fmt.Errorf("Could not read imported file %s: %v", importFile, err)
+		return nil, 0, fmt.Errorf("Could not read imported file %s: %v", importFile, err)
 	}
 	importedTokens := allTokens(importFile, input)
-	return importedTokens, nil
+	if p.included == nil {
+		p.included = make(map[string]lexedFile)
+	}
+	p.included[importFile] = lexedFile{tokens: importedTokens, lines: countLines(input), sum: sha256.Sum256(input)}
+	return importedTokens, countLines(input), nil
 }
 
 // allTokens lexes the entire input, but does not parse it.
@@ -0,0 +1,35 @@
+package nginxconf
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMissingInclude(t *testing.T) {
+	dir := t.TempDir()
+	body := []byte(`http {
+		include missing.conf;
+		server {
+			listen 80;
+			server_name example.com;
+		}
+	}`)
+	cfg, warnings := adapt(t, body, map[string]interface{}{
+		"filename": filepath.Join(dir, "nginx.conf"),
+		"prefix":   dir,
+	})
+	var found bool
+	for _, msg := range warnings {
+		if strings.HasPrefix(msg, "included file is not found, the include is skipped: missing.conf (tried "+filepath.Join(dir, "missing.conf")) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("missing warning about the include, got %q", warnings)
+	}
+	servers, _ := lookup(cfg, "apps.http.servers")
+	checkServers(t, servers, map[string]string{
+		"server_0.listen": `[":80"]`,
+	})
+}
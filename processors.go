@@ -4,17 +4,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"path"
 	"regexp"
+	"regexp/syntax"
+	"slices"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/fileserver"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/headers"
+	maphandler "github.com/caddyserver/caddy/v2/modules/caddyhttp/map"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/requestbody"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy/fastcgi"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/rewrite"
@@ -23,85 +28,156 @@ import (
 
 var splitPathInfoExtension = regexp.MustCompile(`(\.[[:alnum:]]+)`)
 
-func processAllow(dir Directive) map[string]caddyhttp.RequestMatcher {
+// processAllow processes the `allow` directive and returns the matcher set admitting the given
+// address or range. It returns nil if the argument is not a valid address.
+func processAllow(dir Directive) (map[string]caddyhttp.RequestMatcher, []caddyconfig.Warning) {
 	var reqMatcher caddyhttp.RequestMatcher
 	var key string
 	switch dir.Param(1) {
-	case "all":
-		reqMatcher = caddyhttp.MatchRemoteIP{
-			Ranges: []string{"0.0.0.0:0", "::/0"},
-		}
-		key = "remote_ip"
 	case "unix:":
-		reqMatcher = caddyhttp.MatchProtocol("unix")
-		key = "protocol"
+		reqMatcher = unixClientMatcher()
+		key = "not"
 	default:
+		ranges, warns := remoteIPRanges(dir)
+		if len(ranges) == 0 {
+			return nil, warns
+		}
 		reqMatcher = caddyhttp.MatchRemoteIP{
-			Ranges: dir.Params[1:],
+			Ranges: ranges,
 		}
 		key = "remote_ip"
 	}
 	matchConfMap := make(map[string]caddyhttp.RequestMatcher)
 	matchConfMap[key] = reqMatcher
-	return matchConfMap
+	return matchConfMap, nil
 }
 
-func processDeny(dir Directive) (caddyhttp.Subroute, []caddyconfig.Warning) {
+// processAccessRules processes the `allow` and `deny` directives among dirs and returns the
+// subroute applying them in order, where the first rule matching the client decides whether
+// the request is handled by the denied handlers or passed on.
+func processAccessRules(dirs []Directive, denied []json.RawMessage) (*caddyhttp.Subroute, []caddyconfig.Warning) {
 	var warns []caddyconfig.Warning
-	var reqMatcher caddyhttp.RequestMatcher
-	var key string
-	switch dir.Param(1) {
-	case "all":
-		reqMatcher = caddyhttp.MatchRemoteIP{
-			Ranges: []string{"0.0.0.0:0", "::/0"},
+	h := new(caddyhttp.Subroute)
+	for _, dir := range dirs {
+		if dir.Name() != "allow" && dir.Name() != "deny" {
+			continue
 		}
-		key = "remote_ip"
-	case "unix:":
-		reqMatcher = caddyhttp.MatchProtocol("unix")
-		key = "protocol"
-	default:
-		reqMatcher = caddyhttp.MatchRemoteIP{
-			Ranges: dir.Params[1:],
+		// the matcher of the client doesn't depend on the rule
+		ms, w := processAllow(dir)
+		warns = append(warns, w...)
+		if ms == nil {
+			continue
 		}
-		key = "remote_ip"
+		matcherSet := make(caddy.ModuleMap)
+		for k, m := range ms {
+			matcherSet[k] = caddyconfig.JSON(m, &warns)
+		}
+		r := caddyhttp.Route{
+			MatcherSetsRaw: []caddy.ModuleMap{matcherSet},
+			Terminal:       true,
+		}
+		if slices.Contains(dir.Params[1:], "all") {
+			// nginx's `all` includes the clients of UNIX-domain sockets, which have no IP address
+			r.MatcherSetsRaw = append(r.MatcherSetsRaw, caddy.ModuleMap{
+				"not": caddyconfig.JSON(unixClientMatcher(), &warns),
+			})
+		}
+		if dir.Name() == "deny" {
+			r.HandlersRaw = denied
+		}
+		h.Routes = append(h.Routes, r)
+	}
+	if len(h.Routes) == 0 {
+		return nil, warns
 	}
+	return h, warns
+}
 
-	h := caddyhttp.Subroute{
-		Routes: caddyhttp.RouteList{
-			caddyhttp.Route{
-				Terminal: true,
-				HandlersRaw: []json.RawMessage{
-					caddyconfig.JSONModuleObject(caddyhttp.StaticResponse{
-						StatusCode: caddyhttp.WeakString("403"),
-					}, "handler", "static_response", &warns),
-				},
-				MatcherSetsRaw: []caddy.ModuleMap{
-					{
-						key: caddyconfig.JSON(reqMatcher, &warns),
-					},
-				},
+// deniedHandlers returns the handlers of the requests denied by `allow` and `deny`, which get the
+// forbidden page of the scope if any, or a bare 403 response otherwise.
+func (ss *setupState) deniedHandlers(warns *[]caddyconfig.Warning) []json.RawMessage {
+	if ss.forbiddenPage != nil {
+		return ss.forbiddenPage
+	}
+	return []json.RawMessage{
+		caddyconfig.JSONModuleObject(caddyhttp.StaticResponse{
+			StatusCode: caddyhttp.WeakString("403"),
+		}, "handler", "static_response", warns),
+	}
+}
+
+// unixClientMatcher returns the matcher of the clients connected over a UNIX-domain socket,
+// matched by `unix:` in `allow` and `deny`. Such clients have no IP address.
+func unixClientMatcher() caddyhttp.MatchNot {
+	return caddyhttp.MatchNot{
+		MatcherSetsRaw: []caddy.ModuleMap{
+			{
+				"remote_ip": caddyconfig.JSON(caddyhttp.MatchRemoteIP{Ranges: []string{"0.0.0.0/0", "::/0"}}, nil),
 			},
 		},
 	}
-	return h, warns
 }
 
-// processAddHeader processese the `add_heeader` directive and returns the corresponding the handler *headers.Handler
-func processAddHeader(dir Directive) (*headers.Handler, []caddyconfig.Warning) {
+// remoteIPRanges converts the arguments of `allow` and `deny` to the CIDR ranges of the remote_ip
+// matcher. Single addresses become /32 or /128 ranges, and arguments that aren't an address or a
+// range, such as hostnames, are dropped with a warning.
+func remoteIPRanges(dir Directive) ([]string, []caddyconfig.Warning) {
 	var warns []caddyconfig.Warning
+	var ranges []string
+	for _, p := range dir.Params[1:] {
+		if p == "all" {
+			ranges = append(ranges, "0.0.0.0/0", "::/0")
+			continue
+		}
+		if strings.Contains(p, "/") {
+			prefix, err := netip.ParsePrefix(p)
+			if err == nil {
+				ranges = append(ranges, prefix.Masked().String())
+				continue
+			}
+		} else if addr, err := netip.ParseAddr(p); err == nil && addr.Zone() == "" {
+			ranges = append(ranges, netip.PrefixFrom(addr, addr.BitLen()).String())
+			continue
+		}
+		warns = append(warns, caddyconfig.Warning{
+			File:      dir.File,
+			Line:      dir.Line,
+			Directive: dir.Name(),
+			Message:   fmt.Sprintf("%s is not an IP address or CIDR range; hostnames are unsupported", p),
+		})
+	}
+	return ranges, warns
+}
+
+// processAddHeader processese the `add_heeader` directive and returns the corresponding the handler *headers.Handler.
+// A field added by more than one `add_header` directive of scope, such as Set-Cookie, gets all their values.
+func processAddHeader(dir Directive, scope []Directive) (*headers.Handler, []caddyconfig.Warning) {
+	warns := upstreamVarWarnings(dir)
 	hdr := new(headers.Handler)
 
 	hdr.Response = &headers.RespHeaderOps{
 		HeaderOps: new(headers.HeaderOps),
 		Deferred:  true,
 	}
-	hdr.Response.Set = make(http.Header)
-	hdr.Response.Set.Set(dir.Param(1), dir.Param(2))
+	value := replaceNginxVars(dir.Param(2))
+	var occurrences int
+	for _, d := range getAllDirectives(scope, "add_header") {
+		if http.CanonicalHeaderKey(d.Param(1)) == http.CanonicalHeaderKey(dir.Param(1)) {
+			occurrences++
+		}
+	}
+	if occurrences > 1 {
+		hdr.Response.Add = make(http.Header)
+		hdr.Response.Add.Add(dir.Param(1), value)
+	} else {
+		hdr.Response.Set = make(http.Header)
+		hdr.Response.Set.Set(dir.Param(1), value)
+	}
 	if len(dir.Params) == 4 && dir.Param(3) == "always" {
 		hdr.Response.Require = new(caddyhttp.ResponseMatcher)
 		hdr.Response.Require.StatusCode = []int{200, 201, 204, 206, 301, 302, 303, 304, 307, 308}
 		hdr.Response.Require.Headers = http.Header{
-			dir.Param(1): {dir.Param(2)},
+			dir.Param(1): {value},
 		}
 	}
 	return hdr, warns
@@ -149,42 +225,20 @@ func processExpires(dir Directive) (*headers.Handler, []caddyconfig.Warning) {
 			return nil, warns
 		}
 
-		var duration time.Duration
 		// ref: https://nginx.org/en/docs/http/ngx_http_headers_module.html#expires
-		// ref: https://nginx.org/en/docs/syntax.html
-		re := regexp.MustCompile(`(\d{1,})(ms|s|m|h|d|w|M|y)`)
-		matches := re.FindAllStringSubmatch(arg, -1)
-		for i := 0; i < len(matches); i++ {
-			amount, err := strconv.ParseInt(matches[i][1], 10, 64)
-			if err != nil {
-				warns = append(warns, caddyconfig.Warning{
-					File:      dir.File,
-					Line:      dir.Line,
-					Directive: dir.Name(),
-					Message:   err.Error(),
-				})
-				continue
-			}
-			unit := matches[i][2]
-			switch unit {
-			case "ms", "s", "m", "h":
-				d, err := time.ParseDuration(matches[i][0])
-				if err != nil {
-					warns = append(warns, caddyconfig.Warning{
-						File:      dir.File,
-						Line:      dir.Line,
-						Directive: dir.Name(),
-						Message:   err.Error(),
-					})
-				}
-				duration += d
-			case "d":
-				duration += (time.Duration(amount) * time.Hour * 24)
-			case "M":
-				duration += (time.Duration(amount) * time.Hour * 24 * 30)
-			case "y":
-				duration += (time.Duration(amount) * time.Hour * 24 * 365)
-			}
+		if strings.HasPrefix(arg, "-") { // negative time
+			cacheControl = "no-cache"
+			break
+		}
+		duration, err := parseNginxDuration(strings.TrimPrefix(arg, "+"))
+		if err != nil {
+			warns = append(warns, caddyconfig.Warning{
+				File:      dir.File,
+				Line:      dir.Line,
+				Directive: dir.Name(),
+				Message:   err.Error(),
+			})
+			return nil, warns
 		}
 		cacheControl = fmt.Sprintf("max-age=%.0f", duration.Seconds())
 	}
@@ -192,7 +246,317 @@ func processExpires(dir Directive) (*headers.Handler, []caddyconfig.Warning) {
 	return hdr, warns
 }
 
-func processFastCGIPass(dirs []Directive) (*caddyhttp.Subroute, []caddyconfig.Warning) {
+// processClientMaxBodySize processes the `client_max_body_size` directive and returns the corresponding handler
+func processClientMaxBodySize(dir Directive) (*requestbody.RequestBody, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	size, err := parseNginxSize(dir.Param(1))
+	if err != nil {
+		warns = append(warns, caddyconfig.Warning{
+			File:      dir.File,
+			Line:      dir.Line,
+			Directive: dir.Name(),
+			Message:   err.Error(),
+		})
+		return nil, warns
+	}
+	// a size of 0 disables the check in both nginx and Caddy
+	return &requestbody.RequestBody{MaxSize: size}, warns
+}
+
+// processErrorPage processes the `error_page` directive and returns the corresponding route for the
+// error routes of the server. Pages at a local URI are served by a file server rooted at root, while
+// pages at an absolute URL become redirects.
+func processErrorPage(dir Directive, root string) (*caddyhttp.Route, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	codes, uri, override, overridden, plainHTTP := errorPageParams(dir)
+	if len(codes) == 0 && plainHTTP && uri != "" {
+		return nil, warns
+	}
+	if len(codes) == 0 || uri == "" {
+		warns = append(warns, caddyconfig.Warning{
+			File:      dir.File,
+			Line:      dir.Line,
+			Directive: dir.Name(),
+			Message:   "error_page requires at least one status code and a URI",
+		})
+		return nil, warns
+	}
+	if strings.HasPrefix(uri, "@") {
+		warns = append(warns, caddyconfig.Warning{
+			File:      dir.File,
+			Line:      dir.Line,
+			Directive: dir.Name(),
+			Message:   ErrNamedLocation,
+		})
+		return nil, warns
+	}
+
+	route := &caddyhttp.Route{
+		MatcherSetsRaw: []caddy.ModuleMap{
+			{
+				"expression": caddyconfig.JSON(caddyhttp.MatchExpression{
+					Expr: fmt.Sprintf("{http.error.status_code} in [%s]", strings.Join(codes, ", ")),
+				}, &warns),
+			},
+		},
+	}
+	// the page is served with the original status code unless told otherwise
+	status := "{http.error.status_code}"
+	if overridden {
+		status = override
+	}
+	route.HandlersRaw = errorPageHandlers(uri, status, root, &warns)
+	return route, warns
+}
+
+// errorPageParams returns the status codes, the URI and the overriding status code, if any, of the
+// `error_page` directive. The 497 status is reported apart from the other codes.
+func errorPageParams(dir Directive) (codes []string, uri, override string, overridden, plainHTTP bool) {
+	for _, p := range dir.Params[1:] {
+		switch {
+		case p == "497":
+			// Caddy doesn't report plain HTTP requests on TLS ports as errors, see processPlainHTTPRedirect
+			plainHTTP = true
+		case isNumeric(p):
+			codes = append(codes, p)
+		case strings.HasPrefix(p, "="):
+			override, overridden = p[1:], true
+		default:
+			uri = p
+		}
+	}
+	return codes, uri, override, overridden, plainHTTP
+}
+
+// errorPageHandlers returns the handlers serving the page of `error_page` at uri with the given
+// status code. Pages at a local URI are served by a file server rooted at root, while pages at an
+// absolute URL become redirects.
+func errorPageHandlers(uri, status, root string, warns *[]caddyconfig.Warning) []json.RawMessage {
+	if strings.Contains(uri, "://") {
+		// nginx redirects to absolute URLs with 302 unless one of the redirect codes is given
+		redirect := strconv.Itoa(http.StatusFound)
+		switch status {
+		case "301", "302", "303", "307", "308":
+			redirect = status
+		}
+		h := caddyhttp.StaticResponse{
+			StatusCode: caddyhttp.WeakString(redirect),
+			Headers:    http.Header{"Location": []string{replaceNginxVars(uri)}},
+		}
+		return []json.RawMessage{
+			caddyconfig.JSONModuleObject(h, "handler", "static_response", warns),
+		}
+	}
+
+	fileServer := fileserver.FileServer{
+		Root:       root,
+		StatusCode: caddyhttp.WeakString(status),
+	}
+	return []json.RawMessage{
+		caddyconfig.JSONModuleObject(rewrite.Rewrite{URI: replaceNginxVars(uri)}, "handler", "rewrite", warns),
+		caddyconfig.JSONModuleObject(fileServer, "handler", "file_server", warns),
+	}
+}
+
+// processForbiddenPage processes the `error_page` directive of a location, which only the requests
+// denied by `allow` and `deny` get, and returns the handlers serving its page for them.
+// It returns nil if the directive doesn't cover the 403 status.
+func processForbiddenPage(dir Directive, root string) ([]json.RawMessage, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	codes, uri, override, overridden, _ := errorPageParams(dir)
+	var forbidden bool
+	var others []string
+	for _, code := range codes {
+		if code == "403" {
+			forbidden = true
+		} else {
+			others = append(others, code)
+		}
+	}
+	if len(others) > 0 {
+		warns = append(warns, caddyconfig.Warning{
+			File:      dir.File,
+			Line:      dir.Line,
+			Directive: dir.Name(),
+			Message:   fmt.Sprintf("error_page in a location is only converted for the 403 responses of deny, move it to the server block for the status codes %s", strings.Join(others, ", ")),
+		})
+	}
+	if !forbidden || uri == "" {
+		return nil, warns
+	}
+	if strings.HasPrefix(uri, "@") {
+		warns = append(warns, caddyconfig.Warning{
+			File:      dir.File,
+			Line:      dir.Line,
+			Directive: dir.Name(),
+			Message:   ErrNamedLocation,
+		})
+		return nil, warns
+	}
+	status := "403"
+	if overridden {
+		status = override
+	}
+	return errorPageHandlers(uri, status, root, &warns), warns
+}
+
+// processPlainHTTPRedirect reports whether the `error_page` directive handles the 497 status, for
+// plain HTTP requests sent to a TLS port, by redirecting them to the same host and URI over HTTPS.
+// Caddy does the same with the `http_redirect` listener wrapper. Other handling of the 497 status
+// isn't converted.
+func processPlainHTTPRedirect(dir Directive) (bool, []caddyconfig.Warning) {
+	var plainHTTP bool
+	var uri string
+	for _, p := range dir.Params[1:] {
+		switch {
+		case p == "497":
+			plainHTTP = true
+		case isNumeric(p), strings.HasPrefix(p, "="):
+		default:
+			uri = p
+		}
+	}
+	if !plainHTTP {
+		return false, nil
+	}
+	switch uri {
+	case "https://$host$request_uri", "https://$http_host$request_uri", "https://$server_name$request_uri":
+		return true, nil
+	}
+	return false, []caddyconfig.Warning{
+		{
+			File:      dir.File,
+			Line:      dir.Line,
+			Directive: dir.Name(),
+			Message:   "error_page 497 is only converted when redirecting to the same host and URI over HTTPS, e.g. https://$host$request_uri",
+		},
+	}
+}
+
+// tryFilesVars replaces the nginx variables commonly used in the arguments of `try_files` with
+// their Caddy placeholders.
+var tryFilesVars = strings.NewReplacer(
+	"$is_args$args", "?{http.request.uri.query}",
+	"$is_args$query_string", "?{http.request.uri.query}",
+	"$uri", "{http.request.uri.path}",
+	"$document_uri", "{http.request.uri.path}",
+	"$request_uri", "{http.request.uri}",
+	"$args", "{http.request.uri.query}",
+	"$query_string", "{http.request.uri.query}",
+)
+
+// processTryFiles processes the `try_files` directive and returns the subroute serving the first
+// file found under root. Otherwise it falls back to the last argument, which is either a status
+// code, a named location of the server, or a URI the request is rewritten to before the content
+// handlers of the location run.
+func (ss *setupState) processTryFiles(dir Directive, root string) (*caddyhttp.Subroute, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	if len(dir.Params) < 3 {
+		warns = append(warns, caddyconfig.Warning{
+			File:      dir.File,
+			Line:      dir.Line,
+			Directive: dir.Name(),
+			Message:   "try_files requires at least one file and a fallback",
+		})
+		return nil, warns
+	}
+	var files []string
+	for _, f := range dir.Params[1 : len(dir.Params)-1] {
+		files = append(files, tryFilesVars.Replace(f))
+	}
+	// the single-page app idiom, e.g. `try_files $uri $uri/ /index.html`, falls back to a page
+	// served like the other files, so the page is simply the last file tried
+	last := dir.Param(len(dir.Params) - 1)
+	spa := !strings.ContainsAny(last, "$?") && strings.HasPrefix(last, "/") &&
+		(path.Ext(last) == ".html" || path.Ext(last) == ".htm")
+	if spa {
+		files = append(files, last)
+	}
+	found := caddyhttp.Route{
+		MatcherSetsRaw: []caddy.ModuleMap{
+			{
+				"file": caddyconfig.JSON(fileserver.MatchFile{Root: root, TryFiles: files}, &warns),
+			},
+		},
+		HandlersRaw: []json.RawMessage{
+			caddyconfig.JSONModuleObject(rewrite.Rewrite{URI: "{http.matchers.file.relative}"}, "handler", "rewrite", &warns),
+			caddyconfig.JSONModuleObject(fileserver.FileServer{Root: root}, "handler", "file_server", &warns),
+		},
+	}
+
+	if spa {
+		return &caddyhttp.Subroute{Routes: caddyhttp.RouteList{found}}, warns
+	}
+
+	var fallback caddyhttp.Route
+	switch {
+	case strings.HasPrefix(last, "=") && isNumeric(last[1:]):
+		fallback.HandlersRaw = []json.RawMessage{
+			caddyconfig.JSONModuleObject(caddyhttp.StaticResponse{
+				StatusCode: caddyhttp.WeakString(last[1:]),
+			}, "handler", "static_response", &warns),
+		}
+	case strings.HasPrefix(last, "@"):
+		named, ok := ss.namedLocations[last]
+		if !ok {
+			warns = append(warns, caddyconfig.Warning{
+				File:      dir.File,
+				Line:      dir.Line,
+				Directive: dir.Name(),
+				Message:   fmt.Sprintf("unknown named location: %s", last),
+			})
+			return nil, warns
+		}
+		if ss.expanding[locationKey(named)] {
+			warns = append(warns, caddyconfig.Warning{
+				File:      dir.File,
+				Line:      dir.Line,
+				Directive: dir.Name(),
+				Message:   fmt.Sprintf("the named location %s falls back to itself, through try_files; the fallback is ignored", last),
+			})
+			return &caddyhttp.Subroute{Routes: caddyhttp.RouteList{found}}, warns
+		}
+		done := ss.expand(named)
+		routes, w, err := ss.locationContext(map[string]caddyhttp.RequestMatcher{}, named.Block)
+		done()
+		warns = append(warns, w...)
+		if err != nil {
+			warns = append(warns, caddyconfig.Warning{
+				File:      named.File,
+				Line:      named.Line,
+				Directive: named.Name(),
+				Message:   err.Error(),
+			})
+			return nil, warns
+		}
+		fallback.HandlersRaw = []json.RawMessage{
+			caddyconfig.JSONModuleObject(caddyhttp.Subroute{Routes: routes}, "handler", "subroute", &warns),
+		}
+	default:
+		// nginx redirects to the URI with the query string it gives, the original one being
+		// dropped if none is given, e.g. the front controllers of Laravel or Symfony receive the
+		// arguments of the request with `/index.php?$query_string`. Caddy preserves the query
+		// string unless the URI has a `?`.
+		uri := replaceNginxVars(tryFilesVars.Replace(last))
+		if !strings.Contains(uri, "?") {
+			uri += "?"
+		}
+		fallback.HandlersRaw = []json.RawMessage{
+			caddyconfig.JSONModuleObject(rewrite.Rewrite{URI: uri}, "handler", "rewrite", &warns),
+		}
+		if routes := ss.fallbackLocation(last); routes != nil {
+			fallback.HandlersRaw = append(fallback.HandlersRaw,
+				caddyconfig.JSONModuleObject(caddyhttp.Subroute{Routes: routes}, "handler", "subroute", &warns),
+			)
+		}
+	}
+
+	// the file server responds without calling the next handler, so the fallback and the
+	// handlers following the subroute only run if no file is found
+	return &caddyhttp.Subroute{Routes: caddyhttp.RouteList{found, fallback}}, warns
+}
+
+func processFastCGIPass(dirs []Directive, upstreams map[string]Upstream) (*caddyhttp.Subroute, []caddyconfig.Warning) {
 	var warns []caddyconfig.Warning
 
 	// majority fo the code below is copied from:
@@ -293,7 +657,25 @@ func processFastCGIPass(dirs []Directive) (*caddyhttp.Subroute, []caddyconfig.Wa
 		network = "unix"
 		host = (strings.Split(upstream.Path, ":"))[0]
 	}
-	rpHandler.Upstreams = append(rpHandler.Upstreams, &reverseproxy.Upstream{Dial: caddy.JoinNetworkAddress(network, host, upstream.Port())})
+	if u, ok := upstreams[host]; ok && network != "unix" {
+		// the servers of an upstream block, which default to port 80 as with proxy_pass
+		rpHandler.Upstreams = u.serversFor("http")
+		rpHandler.DynamicUpstreamsRaw = u.dynamicUpstreamsFor("http")
+		if u.SelectionPolicy.Name != "" {
+			rpHandler.LoadBalancing = new(reverseproxy.LoadBalancing)
+			rpHandler.LoadBalancing.SelectionPolicyRaw = caddyconfig.JSONModuleObject(u.SelectionPolicy.Selector, "policy", u.SelectionPolicy.Name, nil)
+		}
+		if u.KeepAlive != nil {
+			warns = append(warns, caddyconfig.Warning{
+				File:      passDirective.File,
+				Line:      passDirective.Line,
+				Directive: passDirective.Name(),
+				Message:   fmt.Sprintf("Caddy's FastCGI transport opens a connection per request; the keepalive settings of upstream %s only apply to proxy_pass", host),
+			})
+		}
+	} else {
+		rpHandler.Upstreams = append(rpHandler.Upstreams, &reverseproxy.Upstream{Dial: caddy.JoinNetworkAddress(network, host, upstream.Port())})
+	}
 
 	// create the final reverse proxy route which is
 	// conditional on matching PHP files
@@ -308,8 +690,88 @@ func processFastCGIPass(dirs []Directive) (*caddyhttp.Subroute, []caddyconfig.Wa
 	return subroute, warns
 }
 
-func processProxyPass(dir Directive, upstreams map[string]Upstream) (*reverseproxy.Handler, []caddyconfig.Warning) {
+// processPostAction reports the `post_action` directive, whose request to another location once
+// the response is sent has no equivalent in Caddy. Naming the location helps find the hook, e.g.
+// of billing or analytics, to trigger otherwise, like from the access log.
+func processPostAction(dir Directive) []caddyconfig.Warning {
+	if dir.Param(1) == "off" {
+		return nil
+	}
+	return []caddyconfig.Warning{
+		{
+			File:      dir.File,
+			Line:      dir.Line,
+			Directive: dir.Name(),
+			Message:   fmt.Sprintf("Caddy makes no request once the response is sent; the requests to %s after each response are dropped", dir.Param(1)),
+		},
+	}
+}
+
+// proxySSLMessages explains how the directives configuring TLS towards the upstreams carry over to
+// Caddy, which picks the settings of the connections to HTTPS upstreams by itself. The directives
+// without a message are handled automatically: Caddy reuses the connections to the upstreams,
+// and sends the upstream host name as SNI.
+var proxySSLMessages = map[string]string{
+	"proxy_ssl_session_reuse":       "",
+	"proxy_ssl_server_name":         "",
+	"proxy_ssl_name":                "the name the upstream certificates are verified against isn't converted; set `tls_server_name` of the reverse_proxy transport",
+	"proxy_ssl_verify":              "Caddy verifies the certificates of HTTPS upstreams by default, unlike nginx; upstreams with self-signed certificates need `tls_trusted_ca_certs` or `tls_insecure_skip_verify` of the reverse_proxy transport",
+	"proxy_ssl_verify_depth":        "Caddy verifies the upstream certificate chains up to a trusted CA at any depth; the directive is ignored",
+	"proxy_ssl_trusted_certificate": "the CA certificates trusted for the upstreams aren't converted; set `tls_trusted_ca_certs` of the reverse_proxy transport",
+	"proxy_ssl_crl":                 "Caddy doesn't check upstream certificates against revocation lists; the directive is ignored",
+	"proxy_ssl_certificate":         "client certificates presented to the upstreams aren't converted; set `tls_client_auth` of the reverse_proxy transport",
+	"proxy_ssl_certificate_key":     "client certificates presented to the upstreams aren't converted; set `tls_client_auth` of the reverse_proxy transport",
+	"proxy_ssl_password_file":       "Caddy can't load encrypted keys; decrypt the key of the client certificate presented to the upstreams",
+	"proxy_ssl_protocols":           "Caddy negotiates the TLS versions with the upstreams by itself; the directive is ignored",
+	"proxy_ssl_ciphers":             "Caddy negotiates the cipher suites with the upstreams by itself; the directive is ignored",
+	"proxy_ssl_key_log":             "Caddy doesn't log the TLS keys of the upstream connections; the directive is ignored",
+}
+
+// proxySSLNotice returns the warnings for dir if it's one of the proxy_ssl_* directives
+// configuring TLS towards the upstreams, and whether it is.
+func (ss *setupState) proxySSLNotice(dir Directive) ([]caddyconfig.Warning, bool) {
+	if dir.Name() == "proxy_ssl_conf_command" {
+		return ss.openSSLNotice(dir), true
+	}
+	msg, ok := proxySSLMessages[dir.Name()]
+	if !ok || msg == "" || (dir.Name() == "proxy_ssl_verify" && dir.Param(1) == "on") {
+		return nil, ok
+	}
+	return []caddyconfig.Warning{
+		{
+			File:      dir.File,
+			Line:      dir.Line,
+			Directive: dir.Name(),
+			Message:   msg,
+		},
+	}, true
+}
+
+// proxyPassDirectives are the directives of the proxy module taken into account by processProxyPass
+var proxyPassDirectives = []string{"proxy_pass_request_headers", "proxy_ignore_headers", "proxy_set_header"}
+
+// inheritProxySettings returns the directives of proxyPassDirectives in effect in a scope with the
+// directives dirs, nested in a scope where the directives outer are in effect. As in nginx, the
+// directives of each kind are inherited from the outer scope as a whole, unless the scope has
+// its own: a location with a single `proxy_set_header` passes none of the fields set by the
+// server block.
+func inheritProxySettings(outer, dirs []Directive) []Directive {
+	var settings []Directive
+	for _, name := range proxyPassDirectives {
+		own := getAllDirectives(dirs, name)
+		if len(own) == 0 {
+			own = getAllDirectives(outer, name)
+		}
+		settings = append(settings, own...)
+	}
+	return settings
+}
+
+// processProxyPass processes the `proxy_pass` directive along with the accompanying directives
+// listed in proxyPassDirectives and returns the corresponding reverse_proxy handler
+func processProxyPass(dirs []Directive, upstreams map[string]Upstream) (*reverseproxy.Handler, []caddyconfig.Warning) {
 	var warns []caddyconfig.Warning
+	dir, _ := getDirective(dirs, "proxy_pass")
 	h := &reverseproxy.Handler{
 		Headers: &headers.Handler{
 			Request: &headers.HeaderOps{
@@ -319,6 +781,39 @@ func processProxyPass(dir Directive, upstreams map[string]Upstream) (*reversepro
 			},
 		},
 	}
+	if v, ok := getDirective(dirs, "proxy_pass_request_headers"); ok && v.Param(1) == "off" {
+		// all deletions are applied before the Host header is set
+		h.Headers.Request.Delete = []string{"*"}
+	}
+	for _, d := range getAllDirectives(dirs, "proxy_set_header") {
+		field, value := http.CanonicalHeaderKey(d.Param(1)), d.Param(2)
+		switch {
+		case value == "":
+			// nginx doesn't pass the fields set to an empty value
+			h.Headers.Request.Set.Del(field)
+			h.Headers.Request.Delete = append(h.Headers.Request.Delete, field)
+		case field == "Host" && (value == "$host" || value == "$http_host"):
+			// Caddy passes the Host of the client request unless it's overridden
+			h.Headers.Request.Set.Del(field)
+		case field == "Host" && value == "$proxy_host":
+			// the upstream host is already the default
+		case field == "X-Forwarded-For" && value == "$proxy_add_x_forwarded_for":
+			// Caddy appends the client address to X-Forwarded-For by itself
+		case strings.Contains(value, "$slice_range"):
+			// without slices, the Range of the client request is passed on as is
+			warns = append(warns, caddyconfig.Warning{
+				File:      d.File,
+				Line:      d.Line,
+				Directive: d.Name(),
+				Message:   ErrSlice,
+			})
+		default:
+			h.Headers.Request.Set.Set(field, replaceNginxVars(value))
+		}
+	}
+	// `proxy_ignore_headers` only stops nginx from acting on the listed response headers
+	// (X-Accel-*, Expires, Cache-Control, Set-Cookie, Vary); the headers still reach the client.
+	// Caddy acts on none of them, so the directive is satisfied as is.
 	ur, err := url.Parse(dir.Param(1))
 	if err != nil {
 		warns = append(warns, caddyconfig.Warning{
@@ -364,7 +859,8 @@ func processProxyPass(dir Directive, upstreams map[string]Upstream) (*reversepro
 			h.Upstreams = append(h.Upstreams, &reverseproxy.Upstream{Dial: caddy.JoinNetworkAddress(network, host, u.Port())})
 		}
 	} else {
-		h.Upstreams = u.Servers
+		h.Upstreams = u.serversFor(ur.Scheme)
+		h.DynamicUpstreamsRaw = u.dynamicUpstreamsFor(ur.Scheme)
 		var transport string
 		var rt http.RoundTripper
 		if u.NTLM {
@@ -396,23 +892,27 @@ func processProxyPass(dir Directive, upstreams map[string]Upstream) (*reversepro
 }
 
 // processRewrite returns a Subroute because rewrite require conditional match, and this is attainable
-// by detouring the request into a subroute where the `matcher` is controlled.
-func processRewrite(dir Directive) (caddyhttp.Subroute, []caddyconfig.Warning) {
+// by detouring the request into a subroute where the `matcher` is controlled. The `break` and `last`
+// flags additionally mark the rewrite-phase of the scope identified by breakVar as done. The captures
+// of the enclosing location are given by captures.
+func processRewrite(dir Directive, breakVar string, captures captureVars) (caddyhttp.Subroute, []caddyconfig.Warning) {
 	var warns []caddyconfig.Warning
 	reqMatcher := caddyhttp.MatchPathRE{
-		MatchRegexp: caddyhttp.MatchRegexp{
-			Pattern: dir.Param(1),
-		},
+		MatchRegexp: nginxRegexp("rewrite", dir.Param(1)),
 	}
 	rewriteHandler := rewrite.Rewrite{
-		URI: dir.Param(2),
+		URI: replaceNginxVars(captures.with(reqMatcher.MatchRegexp).replace(dir.Param(2))),
+	}
+	handlers := []json.RawMessage{
+		caddyconfig.JSONModuleObject(rewriteHandler, "handler", "rewrite", &warns),
+	}
+	if rewriteBreaks(dir) {
+		handlers = append(handlers, breakHandler(breakVar, &warns))
 	}
 	subrouteHandler := caddyhttp.Subroute{
 		Routes: caddyhttp.RouteList{
 			caddyhttp.Route{
-				HandlersRaw: []json.RawMessage{
-					caddyconfig.JSONModuleObject(rewriteHandler, "handler", "rewrite", &warns),
-				},
+				HandlersRaw: handlers,
 				MatcherSetsRaw: []caddy.ModuleMap{
 					{
 						"path_regexp": caddyconfig.JSON(reqMatcher, &warns),
@@ -424,7 +924,233 @@ func processRewrite(dir Directive) (caddyhttp.Subroute, []caddyconfig.Warning) {
 	return subrouteHandler, warns
 }
 
-func processReturn(dir Directive) (caddyhttp.StaticResponse, []caddyconfig.Warning) {
+// largeRedirectRun is the number of consecutive `rewrite` directives redirecting single paths
+// from which they're converted to a lookup in a single map handler rather than a route each.
+const largeRedirectRun = 64
+
+// literalRedirect returns the path the `rewrite` directive matches and the URL it redirects to,
+// if it redirects a single path, e.g. `rewrite ^/old\.html$ /new.html permanent;`.
+func literalRedirect(dir Directive) (string, string, bool) {
+	flag, pattern, to := dir.Param(3), dir.Param(1), dir.Param(2)
+	if flag != "permanent" && flag != "redirect" {
+		return "", "", false
+	}
+	if !strings.HasPrefix(pattern, "^") || !strings.HasSuffix(pattern, "$") || strings.HasSuffix(pattern, `\$`) {
+		return "", "", false
+	}
+	re, err := syntax.Parse(pattern[1:len(pattern)-1], syntax.Perl)
+	if err != nil {
+		return "", "", false
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpLiteral || re.Flags&syntax.FoldCase != 0 || mapCaptureRE.MatchString(to) {
+		return "", "", false
+	}
+	return string(re.Rune), to, true
+}
+
+// literalRedirectRuns returns the runs of at least largeRedirectRun consecutive `rewrite`
+// directives among dirs each redirecting a single path with the same flag, by the index of
+// their first directive to the index past their last one.
+func literalRedirectRuns(dirs []Directive) map[int]int {
+	runs := make(map[int]int)
+	sameKind := func(first, dir Directive) bool {
+		_, to, ok := literalRedirect(dir)
+		return ok && dir.Name() == "rewrite" && dir.Param(3) == first.Param(3) &&
+			strings.HasSuffix(to, "?") == strings.HasSuffix(first.Param(2), "?")
+	}
+	for i := 0; i < len(dirs); {
+		end := i
+		for end < len(dirs) && sameKind(dirs[i], dirs[end]) {
+			end++
+		}
+		if end-i >= largeRedirectRun {
+			runs[i] = end
+		}
+		if end == i {
+			end++
+		}
+		i = end
+	}
+	return runs
+}
+
+// processRedirectRun converts a run of `rewrite` directives each redirecting a single path, as
+// returned by literalRedirectRuns, to a map handler looking up the URL to redirect to by path,
+// followed by the redirect. As with nginx, the query string is appended to the URL unless the
+// URLs end with `?`, after a `&` if the URL has a query string of its own.
+func processRedirectRun(dirs []Directive) ([]json.RawMessage, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	const dest, separator = "{nginx_map.redirect}", "{nginx_map.redirect_separator}"
+	h := maphandler.Handler{
+		Source:       "{http.request.uri.path}",
+		Destinations: []string{dest, separator},
+		Defaults:     []string{"", ""},
+	}
+	seen := make(map[string]bool)
+	var keepQuery bool
+	for _, dir := range dirs {
+		from, to, _ := literalRedirect(dir)
+		keepQuery = !strings.HasSuffix(to, "?")
+		if seen[from] {
+			continue // the first redirect of a path applies
+		}
+		seen[from] = true
+		to = strings.TrimSuffix(to, "?")
+		sep := "?"
+		if strings.Contains(to, "?") {
+			sep = "&"
+		}
+		h.Mappings = append(h.Mappings, maphandler.Mapping{
+			Input:   from,
+			Outputs: []interface{}{replaceNginxVars(to), sep},
+		})
+	}
+
+	status := strconv.Itoa(http.StatusFound)
+	if dirs[0].Param(3) == "permanent" {
+		status = strconv.Itoa(http.StatusMovedPermanently)
+	}
+	redirect := func(location string) json.RawMessage {
+		return caddyconfig.JSONModuleObject(caddyhttp.StaticResponse{
+			StatusCode: caddyhttp.WeakString(status),
+			Headers:    http.Header{"Location": []string{location}},
+		}, "handler", "static_response", &warns)
+	}
+	found := caddyconfig.JSON(caddyhttp.MatchNot{
+		MatcherSetsRaw: []caddy.ModuleMap{
+			{
+				"vars": caddyconfig.JSON(caddyhttp.VarsMatcher{dest: []string{""}}, &warns),
+			},
+		},
+	}, &warns)
+
+	var routes caddyhttp.RouteList
+	if keepQuery {
+		routes = append(routes, caddyhttp.Route{
+			MatcherSetsRaw: []caddy.ModuleMap{
+				{
+					"not": found,
+					"expression": caddyconfig.JSON(caddyhttp.MatchExpression{
+						Expr: "{http.request.uri.query} != ''",
+					}, &warns),
+				},
+			},
+			HandlersRaw: []json.RawMessage{redirect(dest + separator + "{http.request.uri.query}")},
+		})
+	}
+	routes = append(routes, caddyhttp.Route{
+		MatcherSetsRaw: []caddy.ModuleMap{{"not": found}},
+		HandlersRaw:    []json.RawMessage{redirect(dest)},
+	})
+
+	return []json.RawMessage{
+		caddyconfig.JSONModuleObject(h, "handler", "map", &warns),
+		caddyconfig.JSONModuleObject(caddyhttp.Subroute{Routes: routes}, "handler", "subroute", &warns),
+	}, warns
+}
+
+// rewriteBreaks reports whether the `rewrite` directive stops processing the rewrite-phase
+// directives of its scope once it matches.
+func rewriteBreaks(dir Directive) bool {
+	flag := dir.Param(3)
+	return flag == "break" || flag == "last"
+}
+
+// The variables tracking whether `break` (or a `rewrite` with the `break` or `last` flag) was
+// executed in the rewrite-phase of the server and location scopes respectively. The variable of a
+// location is numbered after it, so the `break` of a location doesn't skip the directives of the
+// locations it expands in place, e.g. of its try_files fallback.
+const (
+	serverBreakVar   = "nginx_server_break"
+	locationBreakVar = "nginx_location_break"
+)
+
+// breakHandler returns the handler marking the rewrite-phase of the scope identified by breakVar as done.
+// Unlike `return`, nginx carries on serving the request after `break`, so the request is only flagged.
+func breakHandler(breakVar string, warns *[]caddyconfig.Warning) json.RawMessage {
+	return caddyconfig.JSONModuleObject(caddyhttp.VarsMiddleware{breakVar: true}, "handler", "vars", warns)
+}
+
+// guardBreak wraps the handlers of a rewrite-phase directive into a subroute that is skipped once
+// a `break` was executed in the scope identified by breakVar.
+func guardBreak(handlers []json.RawMessage, breakVar string, warns *[]caddyconfig.Warning) json.RawMessage {
+	notBroken := caddy.ModuleMap{
+		"not": caddyconfig.JSON(caddyhttp.MatchNot{
+			MatcherSetsRaw: []caddy.ModuleMap{
+				{
+					"vars": caddyconfig.JSON(caddyhttp.VarsMatcher{breakVar: []string{"true"}}, warns),
+				},
+			},
+		}, warns),
+	}
+	h := caddyhttp.Subroute{
+		Routes: caddyhttp.RouteList{
+			caddyhttp.Route{
+				MatcherSetsRaw: []caddy.ModuleMap{notBroken},
+				HandlersRaw:    handlers,
+			},
+		},
+	}
+	return caddyconfig.JSONModuleObject(h, "handler", "subroute", warns)
+}
+
+// namedCaptureRE finds the `(?<name>...)` named capture syntax, which older Go releases
+// only understand in the `(?P<name>...)` form.
+var namedCaptureRE = regexp.MustCompile(`\(\?<([A-Za-z_][A-Za-z0-9_]*)>`)
+
+// captureRefRE finds references to regexp captures, e.g. `$1`, `$name` or `${name}`.
+var captureRefRE = regexp.MustCompile(`\$(?:\{(\w+)\}|(\d|[A-Za-z_]\w*))`)
+
+// nginxRegexp returns the regexp matcher named name for the nginx regular expression pattern.
+// Naming the matcher makes its captures available as `{http.regexp.<name>.<capture>}`.
+func nginxRegexp(name, pattern string) caddyhttp.MatchRegexp {
+	return caddyhttp.MatchRegexp{
+		Name:    name,
+		Pattern: namedCaptureRE.ReplaceAllString(pattern, "(?P<$1>"),
+	}
+}
+
+// captureVars maps the nginx variables referencing regexp captures to their Caddy placeholders.
+type captureVars map[string]string
+
+// with returns a copy of cv extended with the captures of the regexp matcher m. As with nginx,
+// the numbered captures of m replace the numbered captures of previous matches.
+func (cv captureVars) with(m caddyhttp.MatchRegexp) captureVars {
+	out := make(captureVars, len(cv))
+	for k, v := range cv {
+		if !isNumeric(k) {
+			out[k] = v
+		}
+	}
+	re, err := regexp.Compile(m.Pattern)
+	if err != nil {
+		return out
+	}
+	for i, name := range re.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		out[strconv.Itoa(i)] = fmt.Sprintf("{http.regexp.%s.%d}", m.Name, i)
+		if name != "" {
+			out[name] = fmt.Sprintf("{http.regexp.%s.%s}", m.Name, name)
+		}
+	}
+	return out
+}
+
+// replace substitutes the capture references in s with their placeholders. References to
+// unknown captures are left untouched.
+func (cv captureVars) replace(s string) string {
+	return captureRefRE.ReplaceAllStringFunc(s, func(ref string) string {
+		if v, ok := cv[strings.Trim(ref, "${}")]; ok {
+			return v
+		}
+		return ref
+	})
+}
+
+func processReturn(dir Directive, contentType string) (caddyhttp.StaticResponse, []caddyconfig.Warning) {
 	var warns []caddyconfig.Warning
 	arg := dir.Param(1)
 	h := caddyhttp.StaticResponse{
@@ -433,26 +1159,20 @@ func processReturn(dir Directive) (caddyhttp.StaticResponse, []caddyconfig.Warni
 
 	if isNumeric(arg) {
 		h.StatusCode = caddyhttp.WeakString(arg)
-		secondArg := dir.Param(2)
-		if secondArg != "" {
-			u, err := url.Parse(secondArg)
-			if err != nil { // if it isn't a URL, then it's a body content
-				warns = append(warns, caddyconfig.Warning{
-					File:      dir.File,
-					Line:      dir.Line,
-					Directive: dir.Name(),
-					Message:   err.Error(),
-				})
-				return h, warns
-			} else if u.Scheme == "" && u.Host == "" {
-				h.Body = secondArg
-			} else {
-				h.Headers = http.Header{"Location": []string{u.String()}}
+		switch secondArg := dir.Param(2); {
+		case secondArg == "":
+		case arg == "301" || arg == "302" || arg == "303" || arg == "307" || arg == "308":
+			h.Headers = http.Header{"Location": []string{replaceNginxVars(secondArg)}}
+		default:
+			// the text of the response body is served with the `default_type` in effect
+			h.Body = replaceNginxVars(secondArg)
+			if contentType != "" {
+				h.Headers = http.Header{"Content-Type": []string{contentType}}
 			}
 		}
 	} else {
 		h.StatusCode = caddyhttp.WeakString(strconv.Itoa(http.StatusFound))
-		h.Headers = http.Header{"Location": []string{arg}}
+		h.Headers = http.Header{"Location": []string{replaceNginxVars(arg)}}
 	}
 	return h, warns
 }
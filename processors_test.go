@@ -0,0 +1,72 @@
+package nginxconf
+
+import "testing"
+
+func TestProxySetHeaderInheritance(t *testing.T) {
+	const host = "server_0.routes.0.handle.0.routes.0.handle.0.headers.request.set.Host"
+	runAdaptTests(t, []adaptTest{
+		{
+			name: "Host of the client set in the server block",
+			conf: `http {
+				server {
+					listen 80;
+					proxy_set_header Host $host;
+					location / {
+						proxy_pass http://127.0.0.1:8080;
+					}
+				}
+			}`,
+			want: map[string]string{
+				host: "",
+			},
+		},
+		{
+			name: "Host of the client set in the http context",
+			conf: `http {
+				proxy_set_header Host $http_host;
+				server {
+					listen 80;
+					location / {
+						proxy_pass http://127.0.0.1:8080;
+					}
+				}
+			}`,
+			want: map[string]string{
+				host: "",
+			},
+		},
+		{
+			name: "literal Host set in the server block",
+			conf: `http {
+				proxy_set_header Host $host;
+				server {
+					listen 80;
+					proxy_set_header Host backend.internal;
+					location / {
+						proxy_pass http://127.0.0.1:8080;
+					}
+				}
+			}`,
+			want: map[string]string{
+				host: `["backend.internal"]`,
+			},
+		},
+		{
+			name: "fields of the location replacing the inherited ones",
+			conf: `http {
+				server {
+					listen 80;
+					proxy_set_header Host $host;
+					location / {
+						proxy_set_header X-Tenant acme;
+						proxy_pass http://127.0.0.1:8080;
+					}
+				}
+			}`,
+			want: map[string]string{
+				host: `["{http.reverse_proxy.upstream.host}"]`,
+				"server_0.routes.0.handle.0.routes.0.handle.0.headers.request.set.X-Tenant": `["acme"]`,
+			},
+		},
+	})
+}
@@ -2,6 +2,9 @@ package nginxconf
 
 import (
 	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -16,16 +19,102 @@ func (ss *setupState) serverContext(dirs []Directive) ([]caddyconfig.Warning, er
 	var warnings []caddyconfig.Warning
 
 	srv := new(caddyhttp.Server)
-	srvName := "server_" + strconv.Itoa(len(ss.servers))
 	route := caddyhttp.Route{}
-	// slice of maps
-	var matcherSets []map[string]caddyhttp.RequestMatcher
-	var hostMatcher map[string]caddyhttp.RequestMatcher
 	var logName string
-	var hosts []string
+
+	// the names of all `server_name` directives make up a single host matcher, wherever the
+	// directives appear in the block
+	hosts := serverNames(getAllDirectives(dirs, "server_name"))
+
+	srvName := "server_" + strconv.Itoa(len(ss.servers))
+	if ss.nameServers && len(hosts) > 0 {
+		srvName = hosts[0]
+		// the server blocks sharing their first name, e.g. on different ports, are numbered
+		for i := 2; ss.servers[srvName] != nil; i++ {
+			srvName = hosts[0] + "_" + strconv.Itoa(i)
+		}
+	}
+
+	ss.serverRoot = ""
+	if rootDir, found := getDirective(dirs, "root"); found {
+		ss.serverRoot = rootDir.Param(1)
+	}
+	ss.defaultType = ss.httpDefaultType
+	if dir, found := getDirective(dirs, "default_type"); found {
+		ss.defaultType = dir.Param(1)
+	}
+	if ss.defaultType == "" {
+		ss.defaultType = "text/plain" // the nginx default
+	}
+	ss.namedLocations = make(map[string]Directive)
+	ss.serverLocations = nil
+	ss.serverForbiddenPage = nil
+	for _, dir := range getAllDirectives(dirs, "error_page") {
+		if codes, _, _, _, _ := errorPageParams(dir); slices.Contains(codes, "403") {
+			// the denied requests are reported as errors for the error routes to serve the page
+			ss.serverForbiddenPage = []json.RawMessage{
+				caddyconfig.JSONModuleObject(caddyhttp.StaticError{
+					StatusCode: caddyhttp.WeakString("403"),
+				}, "handler", "error", &warnings),
+			}
+		}
+	}
+	ss.forbiddenPage = ss.serverForbiddenPage
+	ss.serverProxySettings = inheritProxySettings(ss.httpProxySettings, dirs)
+	ss.proxySettings = ss.serverProxySettings
+	for _, dir := range getAllDirectives(dirs, "location") {
+		if strings.HasPrefix(dir.Param(1), "@") {
+			ss.namedLocations[dir.Param(1)] = dir
+		} else {
+			ss.serverLocations = append(ss.serverLocations, dir)
+		}
+	}
+
+	// handlers applying to the whole server, e.g. response header manipulation, wrap the
+	// routes of the server, starting at routesStart
+	var serverHandlers []json.RawMessage
+	var routesStart int
+	var errorPages []Directive
+	// the routes of the locations, which follow the other routes of the server in the order
+	// nginx selects the locations in
+	var locationRoutes []rankedRoute
+
+	// once a `break` is (possibly) executed, the rewrite-phase directives following it
+	// are guarded so they're skipped at runtime.
+	var breakSeen bool
+	rewritePhase := func(hs []json.RawMessage, warns *[]caddyconfig.Warning) []json.RawMessage {
+		if !breakSeen {
+			return hs
+		}
+		return []json.RawMessage{guardBreak(hs, serverBreakVar, warns)}
+	}
+
+	// the routes of the rewrite phase only apply to the hosts of the server, as the locations,
+	// since the servers sharing a listener make up a single Caddy server
+	forHosts := func(r caddyhttp.Route, warns *[]caddyconfig.Warning) caddyhttp.Route {
+		if len(hosts) == 0 {
+			return r
+		}
+		hostMatcher := caddyconfig.JSON(caddyhttp.MatchHost(hosts), warns)
+		if len(r.MatcherSetsRaw) == 0 {
+			r.MatcherSetsRaw = []caddy.ModuleMap{{"host": hostMatcher}}
+		}
+		for _, set := range r.MatcherSetsRaw {
+			set["host"] = hostMatcher
+		}
+		return r
+	}
+
+	// the long runs of `rewrite` directives redirecting single paths are converted at once, the
+	// directives up to the end of the run being skipped
+	redirectRuns := literalRedirectRuns(dirs)
+	var skipUntil int
 
 nextDirective:
-	for _, dir := range dirs {
+	for i, dir := range dirs {
+		if i < skipUntil {
+			continue
+		}
 		var warns []caddyconfig.Warning
 		switch dir.Name() {
 		case "listen":
@@ -46,6 +135,7 @@ nextDirective:
 					if addr == otherAddr {
 						srv = otherSrv
 						srvName = otherSrvName
+						routesStart = len(srv.Routes)
 						continue nextDirective
 					}
 				}
@@ -53,105 +143,49 @@ nextDirective:
 
 			srv.Listen = append(srv.Listen, addr)
 		case "server_name":
-			hostMatcher = map[string]caddyhttp.RequestMatcher{
-				"host": caddyhttp.MatchHost(dir.Params[1:]),
-			}
-			matcherSets = append(matcherSets, hostMatcher)
-			hosts = append(hosts, dir.Params[1:]...)
+			// collected before processing the directives
+			warns = append(warns, wildcardNameWarnings(dir)...)
+		case "default_type": // collected before processing the directives
 		case "location":
-			var matcher caddyhttp.RequestMatcher
-			matchConfMap := make(map[string]caddyhttp.RequestMatcher)
-
-			if len(dir.Params) > 2 {
-				switch dir.Param(1) {
-				case "=":
-					matchConfMap["path"] = caddyhttp.MatchPath(dir.Params[2:])
-				case "~", "~*":
-					pattern := dir.Param(2)
-					if strings.HasSuffix(pattern, "*") {
-						pattern = "(?i)" + pattern // case-insensitive matching
-					}
-					matchConfMap["path_regexp"] = caddyhttp.MatchPathRE{
-						MatchRegexp: caddyhttp.MatchRegexp{
-							Pattern: pattern,
-						},
-					}
-				case "^~":
-					/*
-						What it does is... if it is matched, then no regular expression locations will try to be matched.
-						It basically terminates location block matching.
-						https://www.keycdn.com/support/nginx-location-directive
-					*/
-					matchConfMap["path"] = caddyhttp.MatchPath([]string{dir.Param(2) + "*"})
-					warns = append(warns, caddyconfig.Warning{
-						File:      dir.File,
-						Line:      dir.Line,
-						Directive: dir.Name(),
-						Message:   "the adapter treats the ^~ location modifier as prefix match only, with no prioritization",
-					})
-				}
-			} else if len(dir.Params) == 2 { // only path
-				if strings.HasPrefix(dir.Param(1), "@") {
-					warnings = append(warnings, caddyconfig.Warning{
-						File:      dir.File,
-						Line:      dir.Line,
-						Directive: dir.Name(),
-						Message:   ErrNamedLocation,
-					})
-					continue nextDirective
-				}
-				// append wild character because nginx treat naked path matchers as prefix matchers
-				matcher = caddyhttp.MatchPath([]string{dir.Param(1) + "*"})
-				matchConfMap["path"] = matcher
+			if strings.HasPrefix(dir.Param(1), "@") {
+				// only reached through `try_files`, which converts the named location in place
+				continue nextDirective
 			}
-
-			locationMatcherSet := append(matcherSets[:], matchConfMap)
-			subroutes, warns, err := ss.locationContext(matchConfMap, dir.Block)
-			warnings = append(warnings, warns...)
+			matchConfMap, w := locationMatcher(dir)
+			warns = append(warns, w...)
+			routeMatcher := make(map[string]caddyhttp.RequestMatcher, len(matchConfMap)+1)
+			for k, v := range matchConfMap {
+				routeMatcher[k] = v
+			}
+			if len(hosts) > 0 {
+				routeMatcher["host"] = caddyhttp.MatchHost(hosts)
+			}
+			done := ss.expand(dir)
+			subroutes, w, err := ss.locationContext(matchConfMap, dir.Block)
+			done()
+			warns = append(warns, w...)
 			if err != nil || len(subroutes) == 0 {
-				return warnings, err
+				return append(warnings, warns...), err
 			}
-			var matcherSetsEnc caddyhttp.RawMatcherSets
-			// encode the matchers then set the result as raw matcher config
-			matcherSetsEnc, err = encodeMatcherSets(locationMatcherSet)
+			matcherSetsEnc, err := encodeMatcherSets([]map[string]caddyhttp.RequestMatcher{routeMatcher})
 			if err != nil {
-				return warnings, err
+				return append(warnings, warns...), err
 			}
-			// set the matcher to route
-			route.MatcherSetsRaw = matcherSetsEnc
-
 			h := caddyhttp.Subroute{
 				Routes: subroutes,
 			}
-			route.HandlersRaw = []json.RawMessage{
-				caddyconfig.JSONModuleObject(h, "handler", "subroute", &warns),
-			}
-
-			// append the route
-			srv.Routes = append(srv.Routes, route)
-
-			// empty the route for next iteration
-			route = caddyhttp.Route{}
-		case "root":
-			route.MatcherSetsRaw = []caddy.ModuleMap{
-				{
-					"host": caddyconfig.JSON(hostMatcher["host"], &warns),
+			rank, prefix := locationRank(dir)
+			locationRoutes = append(locationRoutes, rankedRoute{
+				rank:   rank,
+				prefix: prefix,
+				route: caddyhttp.Route{
+					MatcherSetsRaw: matcherSetsEnc,
+					HandlersRaw: []json.RawMessage{
+						caddyconfig.JSONModuleObject(h, "handler", "subroute", &warns),
+					},
 				},
-			}
-			fileServer := fileserver.FileServer{
-				Root: dir.Param(1),
-				// TODO: all remaining fields...
-			}
-			// inject the argument of the index directive if exists
-			if indexDir, found := getDirective(dirs, "index"); found {
-				fileServer.IndexNames = indexDir.Params[1:]
-			}
-
-			route.HandlersRaw = append(route.HandlersRaw,
-				caddyconfig.JSONModuleObject(fileServer, "handler", "file_server", &warns),
-			)
-			// append the route
-			srv.Routes = append(srv.Routes, route)
+			})
+		case "root": // served once no location responded
 		case "access_log":
 			if dir.Param(1) == "off" {
 				continue nextDirective
@@ -160,13 +194,18 @@ nextDirective:
 			// just mark the variable
 			logName = dir.Param(1)
 		case "rewrite":
+			if end, ok := redirectRuns[i]; ok {
+				hs, w := processRedirectRun(dirs[i:end])
+				warns = append(warns, w...)
+				srv.Routes = append(srv.Routes, forHosts(caddyhttp.Route{HandlersRaw: rewritePhase(hs, &warns)}, &warns))
+				skipUntil = end
+				break
+			}
 			reqMatcher := caddyhttp.MatchPathRE{
-				MatchRegexp: caddyhttp.MatchRegexp{
-					Pattern: dir.Param(1),
-				},
+				MatchRegexp: nginxRegexp("rewrite", dir.Param(1)),
 			}
 			rewriteHandler := rewrite.Rewrite{
-				URI: dir.Param(2),
+				URI: replaceNginxVars(captureVars{}.with(reqMatcher.MatchRegexp).replace(dir.Param(2))),
 			}
 			route.MatcherSetsRaw = []caddy.ModuleMap{
 				{
@@ -176,9 +215,14 @@ nextDirective:
 			route.HandlersRaw = []json.RawMessage{
 				caddyconfig.JSONModuleObject(rewriteHandler, "handler", "rewrite", &warns),
 			}
+			if rewriteBreaks(dir) {
+				route.HandlersRaw = append(route.HandlersRaw, breakHandler(serverBreakVar, &warns))
+			}
+			route.HandlersRaw = rewritePhase(route.HandlersRaw, &warns)
+			breakSeen = breakSeen || rewriteBreaks(dir)
 
 			// append the route
-			srv.Routes = append(srv.Routes, route)
+			srv.Routes = append(srv.Routes, forHosts(route, &warns))
 
 			// empty the route for next iteration
 			route = caddyhttp.Route{}
@@ -190,20 +234,81 @@ nextDirective:
 			}
 			route.MatcherSetsRaw = []caddy.ModuleMap{matcher}
 			hs, w := ss.ifContext(dir.Block)
-			route.HandlersRaw = hs
+			route.HandlersRaw = rewritePhase(hs, &warns)
+			breakSeen = breakSeen || ifBreaks(dir.Block)
 
 			// append the route
-			srv.Routes = append(srv.Routes, route)
+			srv.Routes = append(srv.Routes, forHosts(route, &warns))
 
 			// empty the route for next iteration
 			route = caddyhttp.Route{}
 			warns = append(warns, w...)
+		case "error_page":
+			redirect, w := processPlainHTTPRedirect(dir)
+			warns = append(warns, w...)
+			if redirect && srv.ListenerWrappersRaw == nil {
+				// the plain HTTP requests are recognized ahead of the TLS handshake
+				srv.ListenerWrappersRaw = []json.RawMessage{
+					caddyconfig.JSONModuleObject(struct{}{}, "wrapper", "http_redirect", &warns),
+					caddyconfig.JSONModuleObject(struct{}{}, "wrapper", "tls", &warns),
+				}
+			}
+			// processed once the server names are known
+			errorPages = append(errorPages, dir)
+		case "expires":
+			if strings.HasPrefix(dir.Param(1), "$") {
+				hdrs, w := processExpiresMap(dir, ss.maps)
+				warns = append(warns, w...)
+				for _, hdr := range hdrs {
+					serverHandlers = append(serverHandlers, caddyconfig.JSONModuleObject(hdr, "handler", "headers", &warns))
+				}
+			} else {
+				hdr, w := processExpires(dir)
+				warns = append(warns, w...)
+				if hdr != nil {
+					serverHandlers = append(serverHandlers, caddyconfig.JSONModuleObject(hdr, "handler", "headers", &warns))
+				}
+			}
+		case "slice":
+			warns = append(warns, caddyconfig.Warning{
+				File:      dir.File,
+				Line:      dir.Line,
+				Directive: dir.Name(),
+				Message:   ErrSlice,
+			})
+		case "ssl_conf_command", "ssl_buffer_size":
+			warns = append(warns, ss.openSSLNotice(dir)...)
+		case "post_action":
+			warns = append(warns, processPostAction(dir)...)
+		case "ssl_verify_depth":
+			// client certificates are only verified once the client CA is converted, and even
+			// then Caddy verifies the chain up to a trusted CA at any depth
+			warns = append(warns, caddyconfig.Warning{
+				File:      dir.File,
+				Line:      dir.Line,
+				Directive: dir.Name(),
+				Message:   "Caddy's client authentication has no setting for the verification depth; the directive is ignored",
+			})
+		case "proxy_pass_request_headers", "proxy_ignore_headers", "proxy_set_header": // inherited by the locations
+		case "break":
+			route.HandlersRaw = rewritePhase([]json.RawMessage{breakHandler(serverBreakVar, &warns)}, &warns)
+			breakSeen = true
+
+			// append the route
+			srv.Routes = append(srv.Routes, forHosts(route, &warns))
+
+			// empty the route for next iteration
+			route = caddyhttp.Route{}
 		default:
+			if w, ok := ss.proxySSLNotice(dir); ok {
+				warns = append(warns, w...)
+				break
+			}
 			warns = append(warns, caddyconfig.Warning{
 				File:      dir.File,
 				Line:      dir.Line,
 				Directive: dir.Name(),
-				Message:   ErrUnrecognized,
+				Message:   unrecognizedMessage(dir),
 			})
 		}
 		warnings = append(warnings, warns...)
@@ -213,6 +318,100 @@ nextDirective:
 		srv.Routes = append(srv.Routes, route)
 	}
 
+	sort.SliceStable(locationRoutes, func(i, j int) bool {
+		a, b := locationRoutes[i], locationRoutes[j]
+		if a.rank != b.rank {
+			return a.rank < b.rank
+		}
+		// the longest prefix wins, while the regexps are tried in order
+		return len(a.prefix) > len(b.prefix)
+	})
+	for _, r := range locationRoutes {
+		srv.Routes = append(srv.Routes, r.route)
+	}
+
+	// the files under the root of the server are served to the requests that no location
+	// responded to, including those matching no location
+	if ss.serverRoot != "" {
+		fileServer := fileserver.FileServer{
+			Root: ss.serverRoot,
+			// TODO: all remaining fields...
+		}
+		// inject the argument of the index directive if exists
+		if indexDir, found := getDirective(dirs, "index"); found {
+			fileServer.IndexNames = indexDir.Params[1:]
+		}
+		r := caddyhttp.Route{
+			HandlersRaw: []json.RawMessage{
+				caddyconfig.JSONModuleObject(fileServer, "handler", "file_server", &warnings),
+			},
+		}
+		if len(hosts) > 0 {
+			r.MatcherSetsRaw = []caddy.ModuleMap{
+				{
+					"host": caddyconfig.JSON(caddyhttp.MatchHost(hosts), &warnings),
+				},
+			}
+		}
+		srv.Routes = append(srv.Routes, r)
+	}
+
+	// the variables set by maps are computed ahead of the routes of the server referencing them
+	var mapRouteList caddyhttp.RouteList
+	for _, name := range serverMaps(ss.maps, dirs) {
+		m := ss.maps[name]
+		if len(m.Entries) >= largeMap {
+			hs, w := mapHandlers(m)
+			warnings = append(warnings, w...)
+			mapRouteList = append(mapRouteList, caddyhttp.Route{HandlersRaw: hs})
+			continue
+		}
+		rs, w := mapRoutes(m)
+		warnings = append(warnings, w...)
+		mapRouteList = append(mapRouteList, rs...)
+	}
+	if len(mapRouteList) > 0 {
+		h := caddyhttp.Subroute{Routes: mapRouteList}
+		serverHandlers = append([]json.RawMessage{caddyconfig.JSONModuleObject(h, "handler", "subroute", &warnings)}, serverHandlers...)
+	}
+
+	// $server_name is the first name of the server, which the requests carry along as a variable
+	if len(hosts) > 0 && referencesVariable(dirs, "server_name") {
+		h := caddyhttp.VarsMiddleware{"server_name": hosts[0]}
+		serverHandlers = append([]json.RawMessage{caddyconfig.JSONModuleObject(h, "handler", "vars", &warnings)}, serverHandlers...)
+	}
+
+	if len(serverHandlers) > 0 {
+		r := caddyhttp.Route{
+			HandlersRaw: serverHandlers,
+		}
+		if len(hosts) > 0 {
+			r.MatcherSetsRaw = []caddy.ModuleMap{
+				{
+					"host": caddyconfig.JSON(caddyhttp.MatchHost(hosts), &warnings),
+				},
+			}
+		}
+		srv.Routes = append(srv.Routes[:routesStart], append(caddyhttp.RouteList{r}, srv.Routes[routesStart:]...)...)
+	}
+
+	if len(errorPages) > 0 {
+		for _, dir := range errorPages {
+			r, warns := processErrorPage(dir, ss.serverRoot)
+			warnings = append(warnings, warns...)
+			if r == nil {
+				continue
+			}
+			if len(hosts) > 0 {
+				r.MatcherSetsRaw[0]["host"] = caddyconfig.JSON(caddyhttp.MatchHost(hosts), &warnings)
+			}
+			if srv.Errors == nil {
+				srv.Errors = new(caddyhttp.HTTPErrorConfig)
+			}
+			srv.Errors.Routes = append(srv.Errors.Routes, *r)
+		}
+	}
+
 	if logName != "" {
 		loggerName := strings.Join(hosts, "-") + "_log"
 		fileWriter := map[string]interface{}{
@@ -239,8 +438,66 @@ nextDirective:
 		for _, v := range hosts {
 			srv.Logs.LoggerNames[v] = caddyhttp.StringArray{loggerName}
 		}
+		if len(hosts) == 0 {
+			// a catch-all server logs the requests of any host
+			srv.Logs.DefaultLoggerName = loggerName
+		}
 	}
 	ss.servers[srvName] = srv
 
 	return warnings, nil
 }
+
+// rankedRoute is the route of a location along with its rank and the prefix it matches, by which
+// the routes of the locations are ordered, see locationRank.
+type rankedRoute struct {
+	rank   int
+	prefix string
+	route  caddyhttp.Route
+}
+
+// serverNames returns the hosts named by the given `server_name` directives, without duplicates.
+// The catch-all name `_` and the empty name match any host, so they are left out, and a name
+// starting with a dot matches both the domain and its subdomains.
+func serverNames(dirs []Directive) []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	add := func(host string) {
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	for _, dir := range dirs {
+		for _, name := range dir.Params[1:] {
+			switch {
+			case name == "_", name == "":
+			case strings.HasPrefix(name, "."):
+				add(name[1:])
+				add("*" + name)
+			default:
+				add(name)
+			}
+		}
+	}
+	return hosts
+}
+
+// wildcardNameWarnings returns the warnings of the wildcard names of the `server_name` directive
+// dir. In nginx, `.example.com`, `*.example.com` and `www.example.*` match the names with any
+// number of labels in place of the wildcard, e.g. `a.b.example.com`, while a wildcard of the host
+// matcher stands for a single label.
+func wildcardNameWarnings(dir Directive) []caddyconfig.Warning {
+	var warns []caddyconfig.Warning
+	for _, name := range dir.Params[1:] {
+		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "*.") || strings.HasSuffix(name, ".*") {
+			warns = append(warns, caddyconfig.Warning{
+				File:      dir.File,
+				Line:      dir.Line,
+				Directive: dir.Name(),
+				Message:   fmt.Sprintf("the wildcard of %s only matches a single label in Caddy; the names with more labels in its place, matched by nginx, aren't served by this server", name),
+			})
+		}
+	}
+	return warns
+}
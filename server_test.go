@@ -0,0 +1,99 @@
+package nginxconf
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// redirectRun returns a run of largeRedirectRun `rewrite` directives redirecting /old<n> under
+// prefix permanently to the URL given by the format of n.
+func redirectRun(prefix, format string) string {
+	var redirects strings.Builder
+	for i := 0; i < largeRedirectRun; i++ {
+		fmt.Fprintf(&redirects, "rewrite ^%sold%d$ %s permanent;\n", prefix, i, fmt.Sprintf(format, i))
+	}
+	return redirects.String()
+}
+
+func TestRedirectRuns(t *testing.T) {
+	runAdaptTests(t, []adaptTest{
+		{
+			name: "run limited to the hosts of the server",
+			conf: `http {
+				server {
+					listen 80;
+					server_name example.com;
+					` + redirectRun("/", "/new%d") + `
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.match":                                       `[{"host":["example.com"]}]`,
+				"server_0.routes.0.handle.0.handler":                            `"map"`,
+				"server_0.routes.0.handle.0.mappings.0":                         `{"input":"/old0","outputs":["/new0","?"]}`,
+				"server_0.routes.0.handle.1.routes.0.handle.0.headers.Location": `["{nginx_map.redirect}{nginx_map.redirect_separator}{http.request.uri.query}"]`,
+			},
+		},
+		{
+			name: "query string appended to the one of the URLs",
+			conf: `http {
+				server {
+					listen 80;
+					` + redirectRun("/", "/new%d?from=old") + `
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.handle.0.mappings.0": `{"input":"/old0","outputs":["/new0?from=old","&"]}`,
+			},
+		},
+		{
+			name: "query string dropped by the URLs ending with a question mark",
+			conf: `http {
+				server {
+					listen 80;
+					` + redirectRun("/", "/new%d?") + `
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.handle.1.routes.0.handle.0.headers.Location": `["{nginx_map.redirect}"]`,
+				"server_0.routes.0.handle.1.routes.1":                           "",
+			},
+		},
+		{
+			name: "run of a location",
+			conf: `http {
+				server {
+					listen 80;
+					location /legacy/ {
+						` + redirectRun("/legacy/", "/new%d") + `
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.match":                                                    `[{"path":["/legacy/*"]}]`,
+				"server_0.routes.0.handle.0.routes.0.handle.0.handler":                       `"map"`,
+				"server_0.routes.0.handle.0.routes.0.handle.0.mappings.0":                    `{"input":"/legacy/old0","outputs":["/new0","?"]}`,
+				"server_0.routes.0.handle.0.routes.0.handle.1.routes.0.handle.0.status_code": `301`,
+			},
+		},
+	})
+}
+
+func TestWildcardServerNames(t *testing.T) {
+	runAdaptTests(t, []adaptTest{
+		{
+			name: "domain and its subdomains",
+			conf: `http {
+				server {
+					listen 80;
+					server_name .example.com;
+					root /srv/www;
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.match": `[{"host":["example.com","*.example.com"]}]`,
+			},
+			warnings: []string{"the wildcard of .example.com only matches a single label in Caddy; the names with more labels in its place, matched by nginx, aren't served by this server"},
+		},
+	})
+}
@@ -0,0 +1,97 @@
+package nginxconf
+
+import (
+	"encoding/json"
+	"regexp"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// AdaptPerServer converts the NGINX config in body to a separate Caddy JSON config for each
+// Caddy server, keyed by the name of the server, so the virtual hosts can be migrated and
+// reviewed one at a time. Each config holds the loggers its server writes to. The server blocks
+// sharing a listener address make up a single Caddy server, thus a single config. The servers of
+// the stream context get a config each, named stream_0, stream_1 and so on. It takes the same
+// options as Adapt, "name_servers" defaulting to true.
+func AdaptPerServer(body []byte, options map[string]interface{}) (map[string][]byte, []caddyconfig.Warning, error) {
+	opts := map[string]interface{}{"name_servers": true}
+	for k, v := range options {
+		opts[k] = v
+	}
+	ss, _, warnings, err := convert(body, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	configs := make(map[string][]byte, len(ss.servers))
+	for name, srv := range ss.servers {
+		var cfg caddy.Config
+		if srv.Logs != nil && ss.mainConfig.Logging != nil {
+			logs := make(map[string]*caddy.CustomLog)
+			loggerNames := []string{srv.Logs.DefaultLoggerName}
+			for _, names := range srv.Logs.LoggerNames {
+				loggerNames = append(loggerNames, names...)
+			}
+			for _, loggerName := range loggerNames {
+				if l, ok := ss.mainConfig.Logging.Logs[loggerName]; ok {
+					logs[loggerName] = l
+				}
+			}
+			if len(logs) > 0 {
+				cfg.Logging = &caddy.Logging{Logs: logs}
+			}
+		}
+		httpApp := caddyhttp.App{
+			Servers:     map[string]*caddyhttp.Server{name: srv},
+			GracePeriod: ss.gracePeriod,
+		}
+		cfg.AppsRaw = map[string]json.RawMessage{
+			"http": caddyconfig.JSON(httpApp, &warnings),
+		}
+		result, err := encodeConfig(cfg, ss, opts)
+		if err != nil {
+			return nil, warnings, err
+		}
+		configs[name] = result
+	}
+	// the servers of the stream context are migrated on their own as well
+	if ss.layer4 != nil {
+		for name, srv := range ss.layer4.Servers {
+			cfg := caddy.Config{
+				AppsRaw: map[string]json.RawMessage{
+					"layer4": caddyconfig.JSON(l4App{Servers: map[string]*l4Server{name: srv}}, &warnings),
+				},
+			}
+			result, err := encodeConfig(cfg, ss, opts)
+			if err != nil {
+				return nil, warnings, err
+			}
+			configs[name] = result
+		}
+	}
+	return configs, warnings, nil
+}
+
+// encodeConfig returns the JSON of the config cfg of a server converted in ss, stamped and
+// normalized as the options opts ask.
+func encodeConfig(cfg caddy.Config, ss *setupState, opts map[string]interface{}) ([]byte, error) {
+	result, err := json.Marshal(cfg)
+	if v, ok := opts["stamp"].(bool); ok && v && err == nil {
+		result, err = withStamp(result, ss.fingerprint)
+	}
+	if normalize, minify := normalizeOptions(opts); normalize && err == nil {
+		result, err = normalizeJSON(result, minify)
+	}
+	return result, err
+}
+
+// unsafeFilenameChars matches the characters of server names left out of file names, such as the
+// `*` of wildcard names.
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// serverFilename returns the name of the file holding the config of the server named name.
+func serverFilename(name string) string {
+	return unsafeFilenameChars.ReplaceAllString(name, "_") + ".json"
+}
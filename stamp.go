@@ -0,0 +1,85 @@
+package nginxconf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sort"
+)
+
+// modulePath is the path of the adapter's Go module, looked up in the build info for its version.
+const modulePath = "github.com/caddyserver/nginx-adapter"
+
+// stampKey is the key of the output holding the stamp of the adaptation. Caddy removes the `@id`
+// fields before loading a config, so the stamp stays in the config of the running server, which
+// the admin API returns, without being an unknown field.
+const stampKey = "@id"
+
+// withStamp adds the stamp of the adaptation to the Caddy JSON in b, such as
+// `nginx-adapter:v0.1.0:sha256:4f1e…`, telling the version of the adapter and the fingerprint of the
+// nginx config it was produced from.
+func withStamp(b []byte, fingerprint string) ([]byte, error) {
+	var out map[string]json.RawMessage
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	if out == nil {
+		out = make(map[string]json.RawMessage)
+	}
+	var err error
+	out[stampKey], err = json.Marshal(fmt.Sprintf("nginx-adapter:%s:sha256:%s", adapterVersion(), fingerprint))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(out)
+}
+
+// adapterVersion returns the version of the adapter module in the running binary, e.g. as built
+// by xcaddy, or "unknown" if it isn't known.
+func adapterVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	mod := &bi.Main
+	if mod.Path != modulePath {
+		mod = nil
+		for _, dep := range bi.Deps {
+			if dep.Path == modulePath {
+				mod = dep
+				break
+			}
+		}
+	}
+	if mod == nil {
+		return "unknown"
+	}
+	if mod.Replace != nil {
+		// a local checkout replacing the module has no version of its own
+		mod = mod.Replace
+	}
+	if mod.Version == "" {
+		return "unknown"
+	}
+	return mod.Version
+}
+
+// fingerprint returns the hex-encoded SHA-256 checksum of the main config in body and of the
+// files it includes, by path, so any change to the nginx config that was adapted changes it.
+func (p *nginxParser) fingerprint(body []byte) string {
+	paths := make([]string, 0, len(p.included))
+	for path := range p.included {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	h.Write(body)
+	for _, path := range paths {
+		sum := p.included[path].sum
+		fmt.Fprintf(h, "\x00%s\x00%x", path, sum[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,358 @@
+package nginxconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+)
+
+// layer4Plugin is the module of the layer4 app, which the servers of the stream context become.
+const layer4Plugin = "github.com/mholt/caddy-l4"
+
+// The layer4 app isn't a dependency of the adapter, so its config is written with the types below,
+// mirroring the JSON of the app and its proxy handler.
+type (
+	l4App struct {
+		Servers map[string]*l4Server `json:"servers,omitempty"`
+	}
+	l4Server struct {
+		Listen []string  `json:"listen,omitempty"`
+		Routes []l4Route `json:"routes,omitempty"`
+	}
+	l4Route struct {
+		HandlersRaw []json.RawMessage `json:"handle,omitempty"`
+	}
+	l4Proxy struct {
+		Upstreams     []l4Upstream     `json:"upstreams,omitempty"`
+		HealthChecks  *l4HealthChecks  `json:"health_checks,omitempty"`
+		LoadBalancing *l4LoadBalancing `json:"load_balancing,omitempty"`
+	}
+	l4Upstream struct {
+		Dial []string `json:"dial,omitempty"`
+	}
+	l4HealthChecks struct {
+		Passive *l4PassiveHealthChecks `json:"passive,omitempty"`
+	}
+	l4PassiveHealthChecks struct {
+		FailDuration caddy.Duration `json:"fail_duration,omitempty"`
+		MaxFails     int            `json:"max_fails,omitempty"`
+	}
+	l4LoadBalancing struct {
+		SelectionPolicyRaw json.RawMessage `json:"selection_policy,omitempty"`
+	}
+)
+
+// StreamUpstream is an `upstream` block of the stream context.
+type StreamUpstream struct {
+	Servers []StreamServer
+	// Policy is the selection policy of the layer4 proxy, round_robin if empty as nginx
+	// balances the servers by their weight by default.
+	Policy string
+}
+
+// StreamServer is a `server` of a stream upstream with the parameters nginx balances and fails
+// over by. The defaults are those of nginx: a weight of 1 and a server considered unavailable for
+// 10 seconds after a single failure.
+type StreamServer struct {
+	Dial        string
+	Weight      int
+	MaxFails    int
+	FailTimeout time.Duration
+	Backup      bool
+}
+
+// streamContext converts the servers of the `stream` block dirs to the servers of the layer4 app,
+// proxying to the upstreams of the block.
+func (ss *setupState) streamContext(dirs []Directive) ([]caddyconfig.Warning, error) {
+	var warnings []caddyconfig.Warning
+	// the upstreams may be defined after the servers referencing them
+	upstreams := make(map[string]StreamUpstream)
+	for _, dir := range getAllDirectives(dirs, "upstream") {
+		up, warns := streamUpstreamContext(dir.Block)
+		warnings = append(warnings, warns...)
+		upstreams[dir.Param(1)] = up
+	}
+	for _, dir := range dirs {
+		switch dir.Name() {
+		case "upstream": // converted before the servers
+		case "server":
+			srv, warns := streamServerContext(dir.Block, upstreams)
+			warnings = append(warnings, warns...)
+			if srv == nil {
+				continue
+			}
+			if ss.layer4 == nil {
+				ss.layer4 = &l4App{Servers: make(map[string]*l4Server)}
+			}
+			ss.layer4.Servers["stream_"+strconv.Itoa(len(ss.layer4.Servers))] = srv
+		default:
+			warnings = append(warnings, caddyconfig.Warning{
+				File:      dir.File,
+				Line:      dir.Line,
+				Directive: dir.Name(),
+				Message:   unrecognizedMessage(dir),
+			})
+		}
+	}
+	return warnings, nil
+}
+
+// streamUpstreamContext converts the `upstream` block dirs of the stream context. The servers
+// marked `down` are left out.
+func streamUpstreamContext(dirs []Directive) (StreamUpstream, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	var up StreamUpstream
+	for _, dir := range dirs {
+		switch dir.Name() {
+		case "server":
+			s, down, w := streamServer(dir)
+			warns = append(warns, w...)
+			if s.Dial != "" && !down {
+				up.Servers = append(up.Servers, s)
+			}
+		case "least_conn":
+			up.Policy = "least_conn"
+		case "random":
+			up.Policy = "random"
+		case "hash":
+			if dir.Param(1) != "$remote_addr" {
+				warns = append(warns, caddyconfig.Warning{
+					File:      dir.File,
+					Line:      dir.Line,
+					Directive: dir.Name(),
+					Message:   fmt.Sprintf("the layer4 proxy only hashes by the client address, not %s; the servers are balanced in turn", dir.Param(1)),
+				})
+				continue
+			}
+			up.Policy = "ip_hash"
+		default:
+			warns = append(warns, caddyconfig.Warning{
+				File:      dir.File,
+				Line:      dir.Line,
+				Directive: dir.Name(),
+				Message:   unrecognizedMessage(dir),
+			})
+		}
+	}
+	return up, warns
+}
+
+// streamServer parses the `server` directive dir of a stream upstream, and reports whether the
+// server is marked `down`. The address of the server is empty if it's invalid.
+func streamServer(dir Directive) (StreamServer, bool, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	warn := func(msg string) {
+		warns = append(warns, caddyconfig.Warning{
+			File:      dir.File,
+			Line:      dir.Line,
+			Directive: dir.Name(),
+			Message:   msg,
+		})
+	}
+	s := StreamServer{Weight: 1, MaxFails: 1, FailTimeout: 10 * time.Second}
+	dial, ok := streamAddress(dir.Param(1))
+	if !ok {
+		// unlike the servers of the http context, nginx requires the port of stream servers
+		warn(fmt.Sprintf("invalid stream server address, the port is required: %s", dir.Param(1)))
+		return s, false, warns
+	}
+	s.Dial = dial
+	var down bool
+	for _, p := range dir.Params[2:] {
+		name, value, _ := strings.Cut(p, "=")
+		switch name {
+		case "weight", "max_fails":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || (name == "weight" && n == 0) {
+				warn(fmt.Sprintf("invalid %s: %s", name, value))
+				continue
+			}
+			if name == "weight" {
+				s.Weight = n
+			} else {
+				s.MaxFails = n
+			}
+		case "fail_timeout":
+			d, err := parseNginxDuration(value)
+			if err != nil {
+				warn(err.Error())
+				continue
+			}
+			s.FailTimeout = d
+		case "backup":
+			s.Backup = true
+		case "down":
+			down = true
+		default:
+			warn(fmt.Sprintf("unsupported stream server parameter: %s", p))
+		}
+	}
+	return s, down, warns
+}
+
+// streamAddress returns the network address of the layer4 app for the address of a stream
+// server, proxy_pass or listen directive, which is either a UNIX-domain socket or has a port.
+func streamAddress(addr string) (string, bool) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return caddy.JoinNetworkAddress("unix", strings.TrimPrefix(addr, unixPrefix), ""), true
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false
+	}
+	return net.JoinHostPort(host, port), true
+}
+
+// streamServerContext converts the `server` block dirs of the stream context to a server of the
+// layer4 app, or returns nil if it has nowhere to proxy to.
+func streamServerContext(dirs []Directive, upstreams map[string]StreamUpstream) (*l4Server, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	srv := new(l4Server)
+	var handler json.RawMessage
+	for _, dir := range dirs {
+		switch dir.Name() {
+		case "listen":
+			addr := dir.Param(1)
+			if isNumeric(addr) {
+				addr = ":" + addr
+			}
+			network := "tcp"
+			for _, p := range dir.Params[2:] {
+				if p == "udp" {
+					network = "udp"
+					continue
+				}
+				warns = append(warns, caddyconfig.Warning{
+					File:      dir.File,
+					Line:      dir.Line,
+					Directive: dir.Name(),
+					Message:   fmt.Sprintf("unsupported listen parameter: %s", p),
+				})
+			}
+			if strings.HasPrefix(addr, unixPrefix) {
+				network, addr = "unix", strings.TrimPrefix(addr, unixPrefix)
+			}
+			srv.Listen = append(srv.Listen, network+"/"+addr)
+		case "proxy_pass":
+			up, ok := upstreams[dir.Param(1)]
+			if !ok {
+				dial, valid := streamAddress(dir.Param(1))
+				if !valid {
+					warns = append(warns, caddyconfig.Warning{
+						File:      dir.File,
+						Line:      dir.Line,
+						Directive: dir.Name(),
+						Message:   fmt.Sprintf("unknown upstream or address without a port: %s", dir.Param(1)),
+					})
+					continue
+				}
+				up = StreamUpstream{Servers: []StreamServer{{Dial: dial, Weight: 1, MaxFails: 1, FailTimeout: 10 * time.Second}}}
+			}
+			h, w := up.proxy(dir)
+			warns = append(warns, w...)
+			handler = caddyconfig.JSONModuleObject(h, "handler", "proxy", &warns)
+		default:
+			warns = append(warns, caddyconfig.Warning{
+				File:      dir.File,
+				Line:      dir.Line,
+				Directive: dir.Name(),
+				Message:   unrecognizedMessage(dir),
+			})
+		}
+	}
+	if handler == nil || len(srv.Listen) == 0 {
+		return nil, warns
+	}
+	srv.Routes = []l4Route{{HandlersRaw: []json.RawMessage{handler}}}
+	return srv, warns
+}
+
+// proxy returns the layer4 proxy handler balancing the servers of the upstream, for the
+// `proxy_pass` directive dir. The layer4 proxy has neither weights nor backup servers: the
+// servers are listed as many times as their weight, and with backup servers the proxy picks the
+// first available server, the backup servers being listed last. nginx considers a server
+// unavailable after max_fails failures within fail_timeout, which the passive health checks of
+// the proxy do for all the servers at once.
+func (up StreamUpstream) proxy(dir Directive) (*l4Proxy, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	warn := func(msg string) {
+		warns = append(warns, caddyconfig.Warning{
+			File:      dir.File,
+			Line:      dir.Line,
+			Directive: dir.Name(),
+			Message:   msg,
+		})
+	}
+	h := new(l4Proxy)
+	if len(up.Servers) == 0 {
+		return h, warns
+	}
+
+	var primaries, backups []StreamServer
+	for _, s := range up.Servers {
+		if s.Backup {
+			backups = append(backups, s)
+		} else {
+			primaries = append(primaries, s)
+		}
+	}
+	policy := up.Policy
+	switch {
+	case len(backups) > 0:
+		if len(primaries) > 1 {
+			warn("the layer4 proxy has no backup servers, so the servers are tried in order instead, without balancing the primary servers")
+		}
+		policy = "first"
+		for _, s := range append(primaries, backups...) {
+			h.Upstreams = append(h.Upstreams, l4Upstream{Dial: []string{s.Dial}})
+		}
+	case policy == "least_conn" || policy == "ip_hash":
+		for _, s := range primaries {
+			if s.Weight != 1 {
+				warn(fmt.Sprintf("the %s policy of the layer4 proxy doesn't weigh the servers; the weights are ignored", policy))
+				break
+			}
+		}
+		for _, s := range primaries {
+			h.Upstreams = append(h.Upstreams, l4Upstream{Dial: []string{s.Dial}})
+		}
+	default:
+		if policy == "" {
+			policy = "round_robin"
+		}
+		for _, s := range primaries {
+			for i := 0; i < s.Weight; i++ {
+				h.Upstreams = append(h.Upstreams, l4Upstream{Dial: []string{s.Dial}})
+			}
+		}
+	}
+	if len(h.Upstreams) > 1 {
+		h.LoadBalancing = &l4LoadBalancing{
+			SelectionPolicyRaw: caddyconfig.JSONModuleObject(struct{}{}, "policy", policy, &warns),
+		}
+	}
+
+	first := up.Servers[0]
+	for _, s := range up.Servers[1:] {
+		if s.MaxFails != first.MaxFails || s.FailTimeout != first.FailTimeout {
+			warn(fmt.Sprintf("the layer4 proxy checks the health of all the servers alike; the max_fails and fail_timeout of %s apply to every server", first.Dial))
+			break
+		}
+	}
+	// max_fails=0 disables the accounting of failures
+	if first.MaxFails > 0 {
+		h.HealthChecks = &l4HealthChecks{
+			Passive: &l4PassiveHealthChecks{
+				FailDuration: caddy.Duration(first.FailTimeout),
+				MaxFails:     first.MaxFails,
+			},
+		}
+	}
+	return h, warns
+}
@@ -0,0 +1,68 @@
+package nginxconf
+
+import "testing"
+
+func TestStreamUpstreams(t *testing.T) {
+	runAdaptTests(t, []adaptTest{
+		{
+			name: "weights and failures",
+			conf: `stream {
+				upstream db {
+					server 10.0.0.1:5432 weight=2 max_fails=3 fail_timeout=30s;
+					server 10.0.0.2:5432 max_fails=3 fail_timeout=30s;
+				}
+				server {
+					listen 5432;
+					proxy_pass db;
+				}
+			}`,
+			app: "layer4",
+			want: map[string]string{
+				"stream_0.listen":            `["tcp/:5432"]`,
+				"stream_0.routes.0.handle.0": `{"handler":"proxy","health_checks":{"passive":{"fail_duration":30000000000,"max_fails":3}},"load_balancing":{"selection_policy":{"policy":"round_robin"}},"upstreams":[{"dial":["10.0.0.1:5432"]},{"dial":["10.0.0.1:5432"]},{"dial":["10.0.0.2:5432"]}]}`,
+			},
+			warnings: []string{"required plugins: " + layer4Plugin},
+		},
+		{
+			name: "backup server",
+			conf: `stream {
+				server {
+					listen 127.0.0.1:5432;
+					proxy_pass db;
+				}
+				upstream db {
+					server 10.0.0.1:5432;
+					server 10.0.0.2:5432 backup;
+				}
+			}`,
+			app: "layer4",
+			want: map[string]string{
+				"stream_0.listen":            `["tcp/127.0.0.1:5432"]`,
+				"stream_0.routes.0.handle.0": `{"handler":"proxy","health_checks":{"passive":{"fail_duration":10000000000,"max_fails":1}},"load_balancing":{"selection_policy":{"policy":"first"}},"upstreams":[{"dial":["10.0.0.1:5432"]},{"dial":["10.0.0.2:5432"]}]}`,
+			},
+		},
+		{
+			name: "backup server of balanced servers",
+			conf: `stream {
+				upstream dns {
+					server 10.0.0.1:53 max_fails=0;
+					server 10.0.0.2:53 max_fails=0 down;
+					server 10.0.0.3:53 max_fails=0 backup;
+					server 10.0.0.4:53 max_fails=0;
+				}
+				server {
+					listen 53 udp;
+					proxy_pass dns;
+				}
+			}`,
+			app: "layer4",
+			want: map[string]string{
+				"stream_0.listen":                           `["udp/:53"]`,
+				"stream_0.routes.0.handle.0.upstreams":      `[{"dial":["10.0.0.1:53"]},{"dial":["10.0.0.4:53"]},{"dial":["10.0.0.3:53"]}]`,
+				"stream_0.routes.0.handle.0.health_checks":  "",
+				"stream_0.routes.0.handle.0.load_balancing": `{"selection_policy":{"policy":"first"}}`,
+			},
+			warnings: []string{"the layer4 proxy has no backup servers, so the servers are tried in order instead, without balancing the primary servers"},
+		},
+	})
+}
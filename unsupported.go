@@ -0,0 +1,73 @@
+package nginxconf
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+)
+
+// unsupportedKey is the key of the output holding the directives that couldn't be converted,
+// when requested with the "unsupported_metadata" option. Caddy rejects configs with unknown
+// keys, so it has to be removed before the config is loaded.
+const unsupportedKey = "_nginx_unsupported"
+
+// UnsupportedDirective records a directive the adapter couldn't convert, for tooling
+// post-processing the output.
+type UnsupportedDirective struct {
+	Name    string   `json:"name"`
+	Args    []string `json:"args,omitempty"`
+	Context string   `json:"context"`
+	File    string   `json:"file,omitempty"`
+	Line    int      `json:"line,omitempty"`
+}
+
+// unsupportedDirectives returns the directives among dirs that are reported as unrecognized in
+// warnings, along with the context they're found in.
+func unsupportedDirectives(dirs []Directive, warnings []caddyconfig.Warning) []UnsupportedDirective {
+	reported := make(map[caddyconfig.Warning]bool)
+	for _, w := range warnings {
+		if strings.HasPrefix(w.Message, ErrUnrecognized) {
+			reported[caddyconfig.Warning{File: w.File, Line: w.Line, Directive: w.Directive}] = true
+		}
+	}
+	unsupported := []UnsupportedDirective{}
+	var walk func(dirs []Directive, context string)
+	walk = func(dirs []Directive, context string) {
+		for _, dir := range dirs {
+			if reported[caddyconfig.Warning{File: dir.File, Line: dir.Line, Directive: dir.Name()}] {
+				unsupported = append(unsupported, UnsupportedDirective{
+					Name:    dir.Name(),
+					Args:    dir.Params[1:],
+					Context: context,
+					File:    dir.File,
+					Line:    dir.Line,
+				})
+			}
+			walk(dir.Block, dir.Name())
+		}
+	}
+	walk(dirs, "main")
+	return unsupported
+}
+
+// marshalWithUnsupported encodes cfg with the unsupported directives under unsupportedKey.
+func marshalWithUnsupported(cfg caddy.Config, unsupported []UnsupportedDirective) ([]byte, error) {
+	encoded, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &out); err != nil {
+		return nil, err
+	}
+	if out == nil {
+		out = make(map[string]json.RawMessage)
+	}
+	out[unsupportedKey], err = json.Marshal(unsupported)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(out)
+}
@@ -1,11 +1,11 @@
 package nginxconf
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
@@ -20,13 +20,26 @@ type Upstream struct {
 		Selector reverseproxy.Selector
 	}
 	KeepAlive *reverseproxy.KeepAlive
+	// Portless holds the hosts of the servers given without a port, keyed by their index in Servers.
+	Portless map[int]string
+	// Dynamic holds the servers with the `resolve` parameter, whose addresses are looked up
+	// periodically. Their port is empty if none is given.
+	Dynamic []reverseproxy.AUpstreams
+}
+
+// Resolver is the DNS configuration set by the `resolver` and `resolver_timeout` directives.
+type Resolver struct {
+	Addresses []string
+	// Valid overrides the TTL of the looked up addresses.
+	Valid    caddy.Duration
+	Versions *reverseproxy.IPVersions
+	Timeout  caddy.Duration
 }
 
 var nginxPolicyToCaddy = map[string]string{
 	"random":     "random_choose",
 	"least_conn": "least_conn",
 	"ip_hash":    "ip_hash",
-	"hash":       "header",
 }
 
 const unixPrefix = "unix:"
@@ -34,37 +47,56 @@ const unixPrefix = "unix:"
 func (ss *setupState) upstreamContext(dirs []Directive) (Upstream, []caddyconfig.Warning, error) {
 	var upstream Upstream
 	var warns []caddyconfig.Warning
+	// the resolver of the upstream block takes precedence over the one of the http context
+	resolver, w := processResolver(dirs, ss.resolver)
+	warns = append(warns, w...)
 	for _, dir := range dirs {
 		switch dir.Name() {
+		case "resolver", "resolver_timeout": // processed before the servers
 		case "server":
+			if host, port, ok := resolvedServer(dir); ok {
+				upstream.Dynamic = append(upstream.Dynamic, reverseproxy.AUpstreams{
+					Name:        host,
+					Port:        port,
+					Refresh:     resolver.Valid,
+					Resolver:    resolver.upstreamResolver(),
+					DialTimeout: resolver.Timeout,
+					Versions:    resolver.Versions,
+				})
+				continue
+			}
 			// From: https://nginx.org/en/docs/http/ngx_http_upstream_module.html
 			// The address can be specified as a domain name or IP address, with an optional port,
 			// or as a UNIX-domain socket path specified after the “unix:” prefix.
 			addr := dir.Param(1)
-			var network, hostport string = "tcp", addr
+			var u *reverseproxy.Upstream
 			if strings.HasPrefix(addr, unixPrefix) {
-				slicedAddress := strings.Split(addr, "unix:")
-				hostport = slicedAddress[1]
-				network = "unix" // ends up being "unix"
-			}
-			host, port, err := net.SplitHostPort(hostport)
-			if err != nil {
+				u = &reverseproxy.Upstream{Dial: caddy.JoinNetworkAddress("unix", strings.TrimPrefix(addr, unixPrefix), "")}
+			} else if host, port, err := net.SplitHostPort(addr); err == nil {
+				u = &reverseproxy.Upstream{Dial: caddy.JoinNetworkAddress("tcp", host, port)}
+			} else if addrErr, ok := err.(*net.AddrError); ok && addrErr.Err == "missing port in address" {
+				// nginx defaults to port 80, but the port depends on the scheme of the proxy_pass
+				// referencing the upstream, so it's added once the upstream is used.
+				u = &reverseproxy.Upstream{}
+				if upstream.Portless == nil {
+					upstream.Portless = make(map[int]string)
+				}
+				upstream.Portless[len(upstream.Servers)] = strings.Trim(addr, "[]")
+			} else {
 				warns = append(warns, caddyconfig.Warning{
 					File:      dir.File,
 					Line:      dir.Line,
 					Directive: dir.Name(),
-					Message:   fmt.Sprintf("error splitting the host/port of upstream: %s", hostport),
+					Message:   fmt.Sprintf("error splitting the host/port of upstream: %s", addr),
 				})
 				return upstream, warns, err
 			}
-			addr = caddy.JoinNetworkAddress(network, host, port)
-			u := &reverseproxy.Upstream{Dial: addr}
 
 			if len(dir.Params) > 2 {
 				params := dir.Params[2:]
 				for _, v := range params {
 					if strings.HasPrefix(v, "weight") {
-						weight := strings.Split(v, "=")[1]
+						_, weight, _ := strings.Cut(v, "=")
 						w, _ := strconv.ParseInt(weight, 10, 32)
 						u.MaxRequests = int(w)
 					}
@@ -73,24 +105,49 @@ func (ss *setupState) upstreamContext(dirs []Directive) (Upstream, []caddyconfig
 			}
 			upstream.Servers = append(upstream.Servers, u)
 		case "hash":
-			upstream.SelectionPolicy.Name = nginxPolicyToCaddy[dir.Name()]
-			upstream.SelectionPolicy.Selector = reverseproxy.HeaderHashSelection{
-				Field: dir.Param(2),
+			name, selector, ok := hashSelection(dir.Param(1))
+			if !ok {
+				warns = append(warns, caddyconfig.Warning{
+					File:      dir.File,
+					Line:      dir.Line,
+					Directive: dir.Name(),
+					Message:   fmt.Sprintf("unsupported hash key: %s", dir.Param(1)),
+				})
+				continue
 			}
+			upstream.SelectionPolicy.Name = name
+			upstream.SelectionPolicy.Selector = selector
 		case "ip_hash":
 			upstream.SelectionPolicy.Name = nginxPolicyToCaddy[dir.Name()]
 			upstream.SelectionPolicy.Selector = reverseproxy.IPHashSelection{}
 		case "keepalive":
-			upstream.KeepAlive = new(reverseproxy.KeepAlive)
+			if upstream.KeepAlive == nil {
+				upstream.KeepAlive = new(reverseproxy.KeepAlive)
+			}
 			b := true
 			upstream.KeepAlive.Enabled = &b
 			i, _ := strconv.ParseInt(dir.Param(1), 10, 64)
 			upstream.KeepAlive.MaxIdleConns = int(i)
 		case "keepalive_requests":
+			if upstream.KeepAlive == nil {
+				upstream.KeepAlive = new(reverseproxy.KeepAlive)
+			}
 			i, _ := strconv.ParseInt(dir.Param(1), 10, 64)
 			upstream.KeepAlive.MaxIdleConnsPerHost = int(i)
 		case "keepalive_timeout":
-			d, _ := time.ParseDuration(dir.Param(1))
+			d, err := parseNginxDuration(dir.Param(1))
+			if err != nil {
+				warns = append(warns, caddyconfig.Warning{
+					File:      dir.File,
+					Line:      dir.Line,
+					Directive: dir.Name(),
+					Message:   err.Error(),
+				})
+				continue
+			}
+			if upstream.KeepAlive == nil {
+				upstream.KeepAlive = new(reverseproxy.KeepAlive)
+			}
 			upstream.KeepAlive.IdleConnTimeout = caddy.Duration(d)
 		case "ntlm":
 			upstream.NTLM = true
@@ -109,5 +166,204 @@ func (ss *setupState) upstreamContext(dirs []Directive) (Upstream, []caddyconfig
 			})
 		}
 	}
+	if len(upstream.Dynamic) > 0 {
+		// the other servers are looked up along with the resolved ones, see dynamicUpstreamsFor
+		for _, dir := range getAllDirectives(dirs, "server") {
+			if strings.HasPrefix(dir.Param(1), unixPrefix) {
+				warns = append(warns, caddyconfig.Warning{
+					File:      dir.File,
+					Line:      dir.Line,
+					Directive: dir.Name(),
+					Message:   "Caddy can't proxy to UNIX-domain sockets along with servers resolved periodically; the server is left out of the upstream",
+				})
+			}
+		}
+	}
 	return upstream, warns, nil
 }
+
+// hashSelection returns the name and the selector of the selection policy hashing by the given
+// key of the `hash` directive. Only keys made of a single variable which Caddy can hash by are
+// supported.
+func hashSelection(key string) (string, reverseproxy.Selector, bool) {
+	placeholder, ok := nginxKeyPlaceholder(key)
+	if !ok {
+		return "", nil, false
+	}
+	inner := strings.TrimSuffix(strings.TrimPrefix(placeholder, "{"), "}")
+	switch {
+	case placeholder == clientIPPlaceholder:
+		return "client_ip_hash", reverseproxy.ClientIPHashSelection{}, true
+	case placeholder == "{http.request.uri}":
+		return "uri_hash", reverseproxy.URIHashSelection{}, true
+	case strings.HasPrefix(inner, "http.request.header."):
+		return "header", reverseproxy.HeaderHashSelection{Field: strings.TrimPrefix(inner, "http.request.header.")}, true
+	case strings.HasPrefix(inner, "http.request.cookie."):
+		return "cookie", reverseproxy.CookieHashSelection{Name: strings.TrimPrefix(inner, "http.request.cookie.")}, true
+	case strings.HasPrefix(inner, "http.request.uri.query."):
+		return "query", reverseproxy.QueryHashSelection{Key: strings.TrimPrefix(inner, "http.request.uri.query.")}, true
+	}
+	return "", nil, false
+}
+
+// resolvedServer returns the host and the port of the upstream `server` directive if it has the
+// `resolve` parameter, in which case its addresses are looked up periodically.
+func resolvedServer(dir Directive) (string, string, bool) {
+	addr := dir.Param(1)
+	if strings.HasPrefix(addr, unixPrefix) {
+		return "", "", false
+	}
+	if len(dir.Params) < 2 {
+		return "", "", false
+	}
+	for _, v := range dir.Params[2:] {
+		if v == "resolve" {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return strings.Trim(addr, "[]"), "", true
+			}
+			return host, port, true
+		}
+	}
+	return "", "", false
+}
+
+// processResolver processes the `resolver` and `resolver_timeout` directives among dirs and
+// returns the resulting configuration, starting from the one inherited from the outer context.
+func processResolver(dirs []Directive, inherited Resolver) (Resolver, []caddyconfig.Warning) {
+	var warns []caddyconfig.Warning
+	r := inherited
+	if dir, ok := getDirective(dirs, "resolver"); ok {
+		r = Resolver{Timeout: inherited.Timeout}
+		for _, v := range dir.Params[1:] {
+			switch {
+			case strings.HasPrefix(v, "valid="):
+				d, err := parseNginxDuration(strings.TrimPrefix(v, "valid="))
+				if err != nil {
+					warns = append(warns, caddyconfig.Warning{
+						File:      dir.File,
+						Line:      dir.Line,
+						Directive: dir.Name(),
+						Message:   err.Error(),
+					})
+					continue
+				}
+				r.Valid = caddy.Duration(d)
+			case v == "ipv4=off", v == "ipv6=off":
+				if r.Versions == nil {
+					on := true
+					r.Versions = &reverseproxy.IPVersions{IPv4: &on, IPv6: &on}
+				}
+				off := false
+				if v == "ipv4=off" {
+					r.Versions.IPv4 = &off
+				} else {
+					r.Versions.IPv6 = &off
+				}
+			case v == "ipv4=on", v == "ipv6=on":
+			case strings.Contains(v, "="):
+				warns = append(warns, caddyconfig.Warning{
+					File:      dir.File,
+					Line:      dir.Line,
+					Directive: dir.Name(),
+					Message:   fmt.Sprintf("unsupported resolver option: %s", v),
+				})
+			default:
+				// the addresses default to port 53 over UDP, as in nginx
+				r.Addresses = append(r.Addresses, v)
+			}
+		}
+	}
+	if dir, ok := getDirective(dirs, "resolver_timeout"); ok {
+		d, err := parseNginxDuration(dir.Param(1))
+		if err != nil {
+			warns = append(warns, caddyconfig.Warning{
+				File:      dir.File,
+				Line:      dir.Line,
+				Directive: dir.Name(),
+				Message:   err.Error(),
+			})
+		} else {
+			r.Timeout = caddy.Duration(d)
+		}
+	}
+	return r, warns
+}
+
+// upstreamResolver returns the resolver of the dynamic upstreams, or nil to use the system's.
+func (r Resolver) upstreamResolver() *reverseproxy.UpstreamResolver {
+	if len(r.Addresses) == 0 {
+		return nil
+	}
+	return &reverseproxy.UpstreamResolver{Addresses: r.Addresses}
+}
+
+// dynamicUpstreamsFor returns the source of the servers of the upstream with the `resolve`
+// parameter when proxied to with the given scheme, or nil if there are none. Caddy ignores the
+// static upstreams of a proxy with dynamic ones, so the other servers of the upstream are looked
+// up by the source as well, their addresses resolving to themselves. Only the servers listening
+// on a UNIX-domain socket can't be, see upstreamContext.
+func (u Upstream) dynamicUpstreamsFor(scheme string) json.RawMessage {
+	if len(u.Dynamic) == 0 {
+		return nil
+	}
+	port := "80"
+	if scheme == "https" {
+		port = "443"
+	}
+	var sources []json.RawMessage
+	for _, a := range u.Dynamic {
+		if a.Port == "" {
+			a.Port = port
+		}
+		sources = append(sources, caddyconfig.JSONModuleObject(a, "source", "a", nil))
+	}
+	for _, s := range u.staticServersFor(scheme) {
+		host, port, err := net.SplitHostPort(strings.TrimPrefix(s.Dial, "tcp/"))
+		if err != nil {
+			continue // a UNIX-domain socket
+		}
+		a := reverseproxy.AUpstreams{
+			Name:        host,
+			Port:        port,
+			Resolver:    u.Dynamic[0].Resolver,
+			DialTimeout: u.Dynamic[0].DialTimeout,
+		}
+		sources = append(sources, caddyconfig.JSONModuleObject(a, "source", "a", nil))
+	}
+	if len(sources) == 1 {
+		return sources[0]
+	}
+	return caddyconfig.JSONModuleObject(reverseproxy.MultiUpstreams{SourcesRaw: sources}, "source", "multi", nil)
+}
+
+// serversFor returns the static servers of the upstream when proxied to with the given scheme, or
+// nil if the upstream has servers with the `resolve` parameter, which dynamicUpstreamsFor returns
+// along with the other servers.
+func (u Upstream) serversFor(scheme string) reverseproxy.UpstreamPool {
+	if len(u.Dynamic) > 0 {
+		return nil
+	}
+	return u.staticServersFor(scheme)
+}
+
+// staticServersFor returns the servers of the upstream without the `resolve` parameter when
+// proxied to with the given scheme, where the servers given without a port use the default port
+// of the scheme.
+func (u Upstream) staticServersFor(scheme string) reverseproxy.UpstreamPool {
+	if len(u.Portless) == 0 {
+		return u.Servers
+	}
+	port := "80"
+	if scheme == "https" {
+		port = "443"
+	}
+	servers := make(reverseproxy.UpstreamPool, len(u.Servers))
+	copy(servers, u.Servers)
+	for i, host := range u.Portless {
+		s := *servers[i]
+		s.Dial = caddy.JoinNetworkAddress("tcp", host, port)
+		servers[i] = &s
+	}
+	return servers
+}
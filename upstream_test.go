@@ -0,0 +1,27 @@
+package nginxconf
+
+import "testing"
+
+func TestResolvedUpstreams(t *testing.T) {
+	runAdaptTests(t, []adaptTest{
+		{
+			name: "static servers along with resolved ones",
+			conf: `http {
+				upstream backend {
+					server app.internal:8080 resolve;
+					server 10.0.0.5:8080;
+				}
+				server {
+					listen 80;
+					location / {
+						proxy_pass http://backend;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.handle.0.routes.0.handle.0.dynamic_upstreams": `{"source":"multi","sources":[{"name":"app.internal","port":"8080","source":"a"},{"name":"10.0.0.5","port":"8080","source":"a"}]}`,
+				"server_0.routes.0.handle.0.routes.0.handle.0.upstreams":         "",
+			},
+		},
+	})
+}
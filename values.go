@@ -0,0 +1,98 @@
+package nginxconf
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ref: https://nginx.org/en/docs/syntax.html
+var (
+	nginxTimeRE = regexp.MustCompile(`^(\d+)(ms|s|m|h|d|w|M|y)?`)
+	nginxSizeRE = regexp.MustCompile(`^(\d+)([kKmMgG])?$`)
+)
+
+var nginxTimeUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"":   time.Second, // seconds are the default unit
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+	"M":  30 * 24 * time.Hour,
+	"y":  365 * 24 * time.Hour,
+}
+
+var nginxSizeUnits = map[string]int64{
+	"":  1,
+	"k": 1 << 10,
+	"K": 1 << 10,
+	"m": 1 << 20,
+	"M": 1 << 20,
+	"g": 1 << 30,
+	"G": 1 << 30,
+}
+
+// parseNginxDuration parses a time value of the nginx configuration, e.g. `30s`, `1h 30m` or `1d12h`.
+// Values without a unit are in seconds.
+func parseNginxDuration(s string) (time.Duration, error) {
+	v := strings.TrimSpace(s)
+	if v == "" {
+		return 0, fmt.Errorf("empty time value")
+	}
+	var d time.Duration
+	for v != "" {
+		m := nginxTimeRE.FindStringSubmatch(v)
+		if m == nil {
+			return 0, fmt.Errorf("invalid time value: %s", s)
+		}
+		amount, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time value %s: %v", s, err)
+		}
+		d += time.Duration(amount) * nginxTimeUnits[m[2]]
+		v = strings.TrimLeft(v[len(m[0]):], " ")
+	}
+	return d, nil
+}
+
+// parseNginxSize parses a size value of the nginx configuration, e.g. `512k` or `10m`, into bytes.
+func parseNginxSize(s string) (int64, error) {
+	m := nginxSizeRE.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size value: %s", s)
+	}
+	amount, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size value %s: %v", s, err)
+	}
+	return amount * nginxSizeUnits[m[2]], nil
+}
+
+// clientIPPlaceholder is the Caddy placeholder of the client address, which nginx keys zones and
+// hashes by as $remote_addr or, in its packed form, $binary_remote_addr.
+const clientIPPlaceholder = "{http.vars.client_ip}"
+
+// nginxKeyPlaceholder converts a single nginx variable, such as the key of a zone or a hash, to
+// the equivalent Caddy placeholder, from nginxToCaddyVars or the prefix of the variable. It returns
+// false if the variable has no equivalent.
+func nginxKeyPlaceholder(key string) (string, bool) {
+	if v, ok := nginxToCaddyVars[key]; ok {
+		return v, true
+	}
+	switch {
+	// variables prefixed with `$http_` correspond to respective header field with the suffix name
+	// Source: https://nginx.org/en/docs/http/ngx_http_core_module.html#var_http_
+	case strings.HasPrefix(key, "$http_"):
+		name := strings.ReplaceAll(strings.TrimPrefix(key, "$http_"), "_", "-")
+		return "{http.request.header." + name + "}", true
+	case strings.HasPrefix(key, "$cookie_"):
+		return "{http.request.cookie." + strings.TrimPrefix(key, "$cookie_") + "}", true
+	case strings.HasPrefix(key, "$arg_"):
+		return "{http.request.uri.query." + strings.TrimPrefix(key, "$arg_") + "}", true
+	}
+	return "", false
+}
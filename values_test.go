@@ -0,0 +1,60 @@
+package nginxconf
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestClientAddress(t *testing.T) {
+	runAdaptTests(t, []adaptTest{
+		{
+			name: "conditions and hashes by the client address",
+			conf: `http {
+				upstream backend {
+					hash $remote_addr;
+					server 10.0.0.5:8080;
+				}
+				server {
+					listen 80;
+					if ($remote_addr = 10.0.0.1) {
+						return 403;
+					}
+					location / {
+						proxy_pass http://backend;
+					}
+				}
+			}`,
+			want: map[string]string{
+				"server_0.routes.0.match": `[{"vars":{"{http.vars.client_ip}":["10.0.0.1"]}}]`,
+				"server_0.routes.1.handle.0.routes.0.handle.0.load_balancing.selection_policy": `{"policy":"client_ip_hash"}`,
+			},
+		},
+	})
+}
+
+func TestUnknownVariables(t *testing.T) {
+	_, warnings := adapt(t, []byte(`http {
+		map $http_accept_language $lang {
+			default en;
+			~^fr fr;
+		}
+		server {
+			listen 80;
+			set $tenant acme;
+			location ~ ^/(?<section>[a-z]+)/(.*)$ {
+				add_header X-Info "$tenant $lang $section $1 $cookie_id";
+				return 200 "$realpath_root";
+			}
+		}
+	}`), nil)
+	const want = "$realpath_root has no Caddy equivalent and isn't set by set or map; it becomes the empty request variable {http.vars.realpath_root}"
+	if !slices.Contains(warnings, want) {
+		t.Errorf("missing warning %q, got %q", want, warnings)
+	}
+	for _, msg := range warnings {
+		if strings.Contains(msg, "has no Caddy equivalent") && msg != want {
+			t.Errorf("unexpected warning %q", msg)
+		}
+	}
+}